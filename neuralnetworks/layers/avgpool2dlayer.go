@@ -0,0 +1,142 @@
+package layers
+
+import (
+	"fmt"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Average pooling over the channels output by a Conv2DLayer, where each output is the average of a PoolShape window
+of its channel. Like MaxPool2DLayer, the InputShape is picked up automatically from a Conv2DLayer before it, and
+otherwise each datapoint is treated as one tall column.
+
+The window moves Stride rows and columns at a time, which is the PoolShape by default (so the windows don't
+overlap), and the input can be padded according to Padding just like in a Conv2DLayer, so that channels which
+don't divide evenly can still be pooled. The padding doesn't count towards the averages; each output is only the
+average of the real values its window covers.
+*/
+type AvgPool2DLayer struct {
+	PoolShape  Shape
+	InputShape Shape
+
+	Stride       Shape
+	Padding      string
+	PaddingShape Shape
+
+	n_inputs int
+	channels int
+	geometry convGeometry
+	counts   []float64
+}
+
+func (layer *AvgPool2DLayer) Initialize(n_inputs int) {
+	if layer.PoolShape.Rows == 0 || layer.PoolShape.Cols == 0 {
+		fmt.Println("You must specify the PoolShape for an AvgPool2DLayer!")
+		panic(1)
+	}
+
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = Shape{Rows: n_inputs, Cols: 1}
+	}
+
+	if n_inputs%(layer.InputShape.Rows*layer.InputShape.Cols) != 0 {
+		fmt.Printf("%d outputs from the last layer can't be split into %dx%d channels!\n", n_inputs, layer.InputShape.Rows, layer.InputShape.Cols)
+		panic(1)
+	}
+
+	if layer.Stride.Rows == 0 || layer.Stride.Cols == 0 {
+		layer.Stride = layer.PoolShape
+	}
+	if layer.Padding == "" {
+		layer.Padding = ValidPadding
+	}
+
+	layer.n_inputs = n_inputs
+	layer.channels = n_inputs / (layer.InputShape.Rows * layer.InputShape.Cols)
+	layer.geometry = newConvGeometry(layer.InputShape, layer.PoolShape, layer.Stride, 1, layer.Padding, layer.PaddingShape)
+
+	// Count how many real values each window covers, with windows that only cover padding just outputting zero.
+	output := layer.geometry.output
+	layer.counts = make([]float64, output.Rows*output.Cols)
+	layer.geometry.forEach(func(o, _, _ int) {
+		layer.counts[o]++
+	})
+	for o, count := range layer.counts {
+		if count == 0 {
+			layer.counts[o] = 1
+		}
+	}
+}
+
+func (layer *AvgPool2DLayer) setInputShape(shape Shape) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = shape
+	}
+}
+
+func (layer *AvgPool2DLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	_, batchSize := input.Dims()
+	inputLen, outputLen := layer.InputShape.Rows*layer.InputShape.Cols, len(layer.counts)
+
+	output := mat.NewDense(layer.NumOutputs(), batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		inputSlice, outputSlice := mat.Col(nil, b, input), make([]float64, layer.NumOutputs())
+		for c := 0; c < layer.channels; c++ {
+			channelInput, channelOutput := inputSlice[c*inputLen:(c+1)*inputLen], outputSlice[c*outputLen:(c+1)*outputLen]
+			layer.geometry.forEach(func(o, _, i int) {
+				channelOutput[o] += channelInput[i] / layer.counts[o]
+			})
+		}
+		output.SetCol(b, outputSlice)
+	}
+	return output, nil
+}
+
+func (layer *AvgPool2DLayer) Back(_ CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	_, batchSize := forwardGradients.Dims()
+	inputLen, outputLen := layer.InputShape.Rows*layer.InputShape.Cols, len(layer.counts)
+
+	// Each value in the window gets an even share of the gradient of the average
+	backwardGradients := mat.NewDense(layer.n_inputs, batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		gradientSlice, passbackSlice := mat.Col(nil, b, forwardGradients), make([]float64, layer.n_inputs)
+		for c := 0; c < layer.channels; c++ {
+			channelGradients, channelPassback := gradientSlice[c*outputLen:(c+1)*outputLen], passbackSlice[c*inputLen:(c+1)*inputLen]
+			layer.geometry.forEach(func(o, _, i int) {
+				channelPassback[i] += channelGradients[o] / layer.counts[o]
+			})
+		}
+		backwardGradients.SetCol(b, passbackSlice)
+	}
+	return &NilShift{}, backwardGradients
+}
+
+func (layer *AvgPool2DLayer) NumOutputs() int {
+	return layer.channels * len(layer.counts)
+}
+
+func (layer *AvgPool2DLayer) OutputShape() Shape {
+	return layer.geometry.output
+}
+
+func (layer *AvgPool2DLayer) ToBytes() []byte {
+	return save.ConstantsToBytes(
+		layer.PoolShape.Rows, layer.PoolShape.Cols, layer.InputShape.Rows, layer.InputShape.Cols,
+		layer.Stride.Rows, layer.Stride.Cols, paddingToIndex(layer.Padding), layer.PaddingShape.Rows, layer.PaddingShape.Cols,
+	)
+}
+
+func (layer *AvgPool2DLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes)
+	layer.PoolShape = Shape{Rows: constInts[0], Cols: constInts[1]}
+	layer.InputShape = Shape{Rows: constInts[2], Cols: constInts[3]}
+	layer.Stride = Shape{Rows: constInts[4], Cols: constInts[5]}
+	layer.Padding, layer.PaddingShape = indexToPadding(constInts[6]), Shape{Rows: constInts[7], Cols: constInts[8]}
+}
+
+func (layer *AvgPool2DLayer) PrettyPrint() string {
+	return fmt.Sprintf("AvgPool (%dx%d)\nStride %dx%d, %s padding\n", layer.PoolShape.Rows, layer.PoolShape.Cols, layer.Stride.Rows, layer.Stride.Cols, layer.Padding)
+}
@@ -2,6 +2,8 @@ package layers
 
 import (
 	"fmt"
+	"math"
+	"sync"
 
 	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
 	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
@@ -10,165 +12,252 @@ import (
 	"gonum.org/v1/gonum/mat"
 )
 
+/*
+Batch normalization; while training, each input is normalized by the mean and variance it has across
+the batch, then scaled by a learned gamma and shifted by a learned beta. Exponential running averages
+of the batch statistics are kept along the way (each batch keeps Momentum, 0.9 by default, of the old
+average), and those are what get used outside of training.
+
+Since the statistics come from the batch, every batch passed through while training needs more than one
+datapoint; in a Sequential network that means a SubBatch of at least 2, which is why the SubBatch defaults to
+the whole BatchSize when there is a BatchnormLayer in the network. The LSTM network passes one datapoint at a
+time, so it can't have BatchnormLayers in its gates.
+*/
 type BatchnormLayer struct {
+	Momentum float64
+	Epsilon  float64
+
+	// Deprecated: the statistics now come from each batch as it is passed through, and the gradient is
+	// no longer scaled, so these are ignored. They're only kept so that code which sets them still compiles.
 	BatchSize     int
 	GradientScale float64
 
-	means          *mat.Dense
-	stddevs        *mat.Dense
-	trainedMeans   *mat.Dense
-	trainedStddevs *mat.Dense
+	gamma *mat.Dense
+	beta  *mat.Dense
 
-	cache           []*mat.Dense
-	numCachesPopped int
-	n_inputs        int
+	runningMean     *mat.Dense
+	runningVariance *mat.Dense
+	statsMutex      sync.Mutex
 
-	appendChannel chan *mat.Dense
+	n_inputs int
+	training bool
 }
 
+// The version of the byte layout written by ToBytes, after a leading zero that older saves never start with.
+const batchnormSaveVersion = 1
+
 func (layer *BatchnormLayer) Initialize(n_inputs int) {
 	layer.n_inputs = n_inputs
-	if layer.GradientScale == 0 {
-		layer.GradientScale = 1
+	if layer.Momentum == 0 {
+		layer.Momentum = 0.9
 	}
-	if layer.BatchSize == 0 {
-		layer.BatchSize = 30
+	if layer.Epsilon == 0 {
+		layer.Epsilon = 1e-5
 	}
 
-	layer.appendChannel = make(chan *mat.Dense)
-	go layer.recordCache()
-
-	if layer.means != nil {
+	if layer.gamma != nil {
 		return
 	}
 
-	layer.means, layer.trainedMeans = mat.NewDense(n_inputs, 1, nil), mat.NewDense(n_inputs, 1, nil)
-	layer.stddevs, layer.trainedStddevs = utils.FromSlice(utils.Duplicate(1.0, n_inputs)), utils.FromSlice(utils.Duplicate(1.0, n_inputs))
+	layer.gamma, layer.beta = utils.FromSlice(utils.Duplicate(1.0, n_inputs)), mat.NewDense(n_inputs, 1, nil)
+	layer.runningMean, layer.runningVariance = mat.NewDense(n_inputs, 1, nil), utils.FromSlice(utils.Duplicate(1.0, n_inputs))
 }
 
-func (layer *BatchnormLayer) recordCache() {
-	val := <-layer.appendChannel
-	for {
-		layer.cache = append(layer.cache, val)
-		val = <-layer.appendChannel
-	}
+func (layer *BatchnormLayer) SetTraining(training bool) {
+	layer.training = training
 }
 
-func (layer *BatchnormLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
-	// Check for means and standard deviations of values coming in.
-	layer.appendChannel <- input
-
-	// Normalize, then rescale.
-	_, cols := input.Dims()
-	normed, output := utils.DenseLike(input), utils.DenseLike(input)
-	normed.Apply(func(i int, j int, v float64) float64 {
-		return (v - layer.means.At(i*cols+j, 0)) / layer.stddevs.At(i*cols+j, 0)
-	}, input)
-	output.Apply(func(i int, j int, v float64) float64 {
-		return v*layer.trainedStddevs.At(i*cols+j, 0) + layer.trainedMeans.At(i*cols+j, 0)
-	}, normed)
-
-	return output, &BatchNormCache{Normed: normed}
+// Checks whether there's a BatchnormLayer anywhere in the stack, including inside layers like a ResidualLayer.
+func HasBatchnorm(stack []Layer) bool {
+	for _, layer := range stack {
+		switch l := layer.(type) {
+		case *BatchnormLayer:
+			return true
+		case containerLayer:
+			if HasBatchnorm(l.sublayers()) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// When we've accumulated a sufficiently large cache, we update our tracked means and stddevs.
-func (layer *BatchnormLayer) popCache() {
-	values := make([][]float64, layer.n_inputs)
-	for _, stored := range layer.cache {
-		if stored != nil {
-			for i, val := range utils.GetSlice(stored) {
-				values[i] = append(values[i], val)
-			}
+// Gets the mean and (biased) variance of each row across the batch.
+func batchStatistics(input *mat.Dense) (*mat.Dense, *mat.Dense) {
+	rows, batchSize := input.Dims()
+	means, variances := make([]float64, rows), make([]float64, rows)
+	for i := 0; i < rows; i++ {
+		row := input.RawRowView(i)
+		means[i] = utils.Sum(row) / float64(batchSize)
+		for _, v := range row {
+			variances[i] += (v - means[i]) * (v - means[i])
 		}
+		variances[i] /= float64(batchSize)
 	}
+	return utils.FromSlice(means), utils.FromSlice(variances)
+}
 
-	meanSlice, stddevSlice := make([]float64, layer.n_inputs), make([]float64, layer.n_inputs)
+// Folds a batch's statistics into the running averages, using the unbiased variance.
+func (layer *BatchnormLayer) updateRunningStatistics(means *mat.Dense, variances *mat.Dense, batchSize int) {
+	layer.statsMutex.Lock()
+	defer layer.statsMutex.Unlock()
+
+	correction := float64(batchSize) / float64(batchSize-1)
+	layer.runningMean.Apply(func(i, _ int, v float64) float64 {
+		return layer.Momentum*v + (1-layer.Momentum)*means.At(i, 0)
+	}, layer.runningMean)
+	layer.runningVariance.Apply(func(i, _ int, v float64) float64 {
+		return layer.Momentum*v + (1-layer.Momentum)*variances.At(i, 0)*correction
+	}, layer.runningVariance)
+}
 
-	utils.ForEach(values, func(i int, vals []float64) {
-		mean, stddev := utils.GetDistribution(vals)
-		meanSlice[i], stddevSlice[i] = mean/float64(layer.numCachesPopped+1), stddev/float64(layer.numCachesPopped+1)
-	})
+func (layer *BatchnormLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	_, batchSize := input.Dims()
+	if layer.training && batchSize == 1 {
+		panic("A BatchnormLayer can't train on one datapoint at a time, since it normalizes across the batch! Give it a SubBatch of at least 2.")
+	}
 
-	layer.means.Scale(float64(layer.numCachesPopped)/float64(layer.numCachesPopped+1), layer.means)
-	layer.stddevs.Scale(float64(layer.numCachesPopped)/float64(layer.numCachesPopped+1), layer.stddevs)
+	var means, variances *mat.Dense
+	if layer.training {
+		means, variances = batchStatistics(input)
+		layer.updateRunningStatistics(means, variances, batchSize)
+	} else {
+		layer.statsMutex.Lock()
+		means, variances = mat.DenseCopyOf(layer.runningMean), mat.DenseCopyOf(layer.runningVariance)
+		layer.statsMutex.Unlock()
+	}
 
-	layer.means.Add(layer.means, utils.FromSlice(meanSlice))
-	layer.stddevs.Add(layer.stddevs, utils.FromSlice(stddevSlice))
+	invStddevs := utils.DenseLike(variances)
+	invStddevs.Apply(func(_, _ int, v float64) float64 {
+		return 1 / math.Sqrt(v+layer.Epsilon)
+	}, variances)
 
-	layer.cache = make([]*mat.Dense, 0)
-	layer.numCachesPopped++
+	// Normalize, then rescale.
+	normed, output := utils.DenseLike(input), utils.DenseLike(input)
+	normed.Apply(func(i int, _ int, v float64) float64 {
+		return (v - means.At(i, 0)) * invStddevs.At(i, 0)
+	}, input)
+	output.Apply(func(i int, _ int, v float64) float64 {
+		return v*layer.gamma.At(i, 0) + layer.beta.At(i, 0)
+	}, normed)
+
+	return output, &BatchNormCache{Normed: normed, InvStddevs: invStddevs, BatchStatistics: layer.training}
 }
 
 func (layer *BatchnormLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
-	meanShifts := utils.DenseLike(layer.means)
-	normedSlice := utils.GetSlice(cache.(*BatchNormCache).Normed)
-
-	// Calculate the Local Gradients
-	_, cols := forwardGradients.Dims()
-	stddevShifts := utils.FromSlice(utils.MapWithIndex(utils.GetSlice(forwardGradients), func(i int, v float64) float64 {
-		return v * normedSlice[i] * layer.GradientScale
-	}))
-	meanShifts.Copy(forwardGradients)
-
-	// Rescale the gradients to pass back
-	forwardGradients.Apply(func(i, j int, v float64) float64 {
-		return v * layer.trainedStddevs.At(i*cols+j, 0) / layer.stddevs.At(i*cols+j, 0)
+	batchCache := cache.(*BatchNormCache)
+	normed, invStddevs := batchCache.Normed, batchCache.InvStddevs
+	rows, batchSize := forwardGradients.Dims()
+
+	// The shifts for gamma and beta
+	weightedGradients := utils.DenseLike(forwardGradients)
+	weightedGradients.MulElem(forwardGradients, normed)
+	gammaShift, betaShift := utils.SumColumns(weightedGradients), utils.SumColumns(forwardGradients)
+
+	// The gradient with respect to the normalized values
+	normedGradients := utils.DenseLike(forwardGradients)
+	normedGradients.Apply(func(i, _ int, v float64) float64 {
+		return v * layer.gamma.At(i, 0)
 	}, forwardGradients)
 
-	return &BatchNormShift{meanShift: meanShifts, stddevShift: stddevShifts}, forwardGradients
+	// If the batch's own statistics were used, the mean and variance depend on every input in the batch too.
+	backwardGradients := utils.DenseLike(forwardGradients)
+	if !batchCache.BatchStatistics {
+		backwardGradients.Apply(func(i, _ int, v float64) float64 {
+			return v * invStddevs.At(i, 0)
+		}, normedGradients)
+		return &BatchNormShift{gammaShift: gammaShift, betaShift: betaShift}, backwardGradients
+	}
+
+	n := float64(batchSize)
+	for i := 0; i < rows; i++ {
+		gradientRow, normedRow := normedGradients.RawRowView(i), normed.RawRowView(i)
+		gradientSum, weightedSum := utils.Sum(gradientRow), utils.Sum(utils.DoubleMap(gradientRow, normedRow, func(g, x float64) float64 { return g * x }))
+
+		backwardRow := backwardGradients.RawRowView(i)
+		for b := range backwardRow {
+			backwardRow[b] = invStddevs.At(i, 0) / n * (n*gradientRow[b] - gradientSum - normedRow[b]*weightedSum)
+		}
+	}
+
+	return &BatchNormShift{gammaShift: gammaShift, betaShift: betaShift}, backwardGradients
 }
 
 func (layer *BatchnormLayer) NumOutputs() int {
 	return layer.n_inputs
 }
 
+func (layer *BatchnormLayer) NumParameters() int {
+	return countParameters(layer.gamma, layer.beta)
+}
+
 func (layer *BatchnormLayer) ToBytes() []byte {
-	bytes := save.ConstantsToBytes(layer.n_inputs, layer.numCachesPopped, layer.BatchSize)
-	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.means))...)
-	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.stddevs))...)
-	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.trainedMeans))...)
-	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.trainedStddevs))...)
+	bytes := save.ConstantsToBytes(0, batchnormSaveVersion, layer.n_inputs)
+	bytes = append(bytes, save.ToBytes([]float64{layer.Momentum, layer.Epsilon})...)
+	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.gamma))...)
+	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.beta))...)
+	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.runningMean))...)
+	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.runningVariance))...)
 	return bytes
 }
 
 func (layer *BatchnormLayer) FromBytes(bytes []byte) {
+	// Older saves start with the number of inputs, and then hold the tracked means and standard deviations
+	// followed by the trained means and standard deviations, which are the same thing as beta and gamma.
+	if save.ConstantsFromBytes(bytes[:4])[0] != 0 {
+		constants := save.ConstantsFromBytes(bytes[:12])
+		layer.n_inputs, bytes = constants[0], bytes[12:]
+		values := save.FromBytes(bytes)
+		n := layer.n_inputs
+
+		stddevs := values[n : 2*n]
+		layer.runningMean = utils.FromSlice(values[:n])
+		layer.runningVariance = utils.FromSlice(utils.Map(stddevs, func(stddev float64) float64 { return stddev * stddev }))
+		layer.beta, layer.gamma = utils.FromSlice(values[2*n:3*n]), utils.FromSlice(values[3*n:4*n])
+		return
+	}
+
 	constants := save.ConstantsFromBytes(bytes[:12])
-	layer.n_inputs, layer.numCachesPopped, layer.BatchSize, bytes = constants[0], constants[1], constants[2], bytes[12:]
-	layer.means, layer.stddevs = utils.FromSlice(save.FromBytes(bytes[:layer.n_inputs*8])), utils.FromSlice(save.FromBytes(bytes[layer.n_inputs*8:layer.n_inputs*16]))
-	layer.trainedMeans, layer.trainedStddevs = utils.FromSlice(save.FromBytes(bytes[layer.n_inputs*16:layer.n_inputs*24])), utils.FromSlice(save.FromBytes(bytes[layer.n_inputs*24:]))
+	if constants[1] > batchnormSaveVersion {
+		panic(fmt.Sprintf("This BatchnormLayer was saved with a newer layout (version %d) than this version of the library can read!", constants[1]))
+	}
+	layer.n_inputs = constants[2]
+	values := save.FromBytes(bytes[12:])
+	n := layer.n_inputs
+
+	layer.Momentum, layer.Epsilon, values = values[0], values[1], values[2:]
+	layer.gamma, layer.beta = utils.FromSlice(values[:n]), utils.FromSlice(values[n:2*n])
+	layer.runningMean, layer.runningVariance = utils.FromSlice(values[2*n:3*n]), utils.FromSlice(values[3*n:4*n])
 }
 
 func (layer *BatchnormLayer) PrettyPrint() string {
-	return fmt.Sprintf("Batchnorm Layer\nMeans: %.4f,\nStdDevs: %.4f\nTrained Means: %.4f\nTrained StdDevs: %.4f\n", utils.GetSlice(layer.means), utils.GetSlice(layer.stddevs), utils.GetSlice(layer.trainedMeans), utils.GetSlice(layer.trainedStddevs))
+	return fmt.Sprintf("Batchnorm Layer\nGamma: %.4f\nBeta: %.4f\nRunning Means: %.4f\nRunning Variances: %.4f\n", utils.GetSlice(layer.gamma), utils.GetSlice(layer.beta), utils.GetSlice(layer.runningMean), utils.GetSlice(layer.runningVariance))
 }
 
 type BatchNormShift struct {
-	meanShift   *mat.Dense
-	stddevShift *mat.Dense
+	gammaShift *mat.Dense
+	betaShift  *mat.Dense
 }
 
 func (b *BatchNormShift) Apply(rawlayer Layer, scale float64) {
 	layer := rawlayer.(*BatchnormLayer)
-	if len(layer.cache) >= layer.BatchSize {
-		layer.popCache()
-	}
 
-	b.meanShift.Scale(scale, b.meanShift)
-	layer.trainedMeans.Add(layer.trainedMeans, b.meanShift)
+	b.gammaShift.Scale(scale, b.gammaShift)
+	layer.gamma.Add(layer.gamma, b.gammaShift)
 
-	b.stddevShift.Scale(scale, b.stddevShift)
-	layer.trainedStddevs.Add(layer.trainedStddevs, b.stddevShift)
+	b.betaShift.Scale(scale, b.betaShift)
+	layer.beta.Add(layer.beta, b.betaShift)
 }
 
 func (b *BatchNormShift) Combine(b2 ShiftType) ShiftType {
-	b.meanShift.Add(b.meanShift, b2.(*BatchNormShift).meanShift)
-	b.stddevShift.Add(b.stddevShift, b2.(*BatchNormShift).stddevShift)
+	b.gammaShift.Add(b.gammaShift, b2.(*BatchNormShift).gammaShift)
+	b.betaShift.Add(b.betaShift, b2.(*BatchNormShift).betaShift)
 
 	return b
 }
 
 func (b *BatchNormShift) Optimize(opt optimizers.Optimizer, index int) {
-	b.meanShift, b.stddevShift = opt.Rescale(b.meanShift, index), opt.Rescale(b.stddevShift, index+1)
+	b.gammaShift, b.betaShift = opt.Rescale(b.gammaShift, index), opt.Rescale(b.betaShift, index+1)
 }
 
 func (b *BatchNormShift) NumMatrices() int {
@@ -176,6 +265,15 @@ func (b *BatchNormShift) NumMatrices() int {
 }
 
 func (b *BatchNormShift) Scale(f float64) {
-	b.meanShift.Scale(f, b.meanShift)
-	b.stddevShift.Scale(f, b.stddevShift)
+	b.gammaShift.Scale(f, b.gammaShift)
+	b.betaShift.Scale(f, b.betaShift)
+}
+
+func (b *BatchNormShift) SquaredNorm() float64 {
+	return utils.SquaredNorm(b.gammaShift) + utils.SquaredNorm(b.betaShift)
+}
+
+func (b *BatchNormShift) Clip(limit float64) {
+	utils.ClipValues(b.gammaShift, limit)
+	utils.ClipValues(b.betaShift, limit)
 }
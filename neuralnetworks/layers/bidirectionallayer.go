@@ -0,0 +1,223 @@
+package layers
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+RECURRENTLAYER - Layers that read their input as a sequence of chunks, one step at a time (like LSTMLayer).
+
+ChunkSizes () (inputSize int, outputSize int): How many values each step reads in, and how many it writes out.
+*/
+type RecurrentLayer interface {
+	Layer
+	ChunkSizes() (int, int)
+}
+
+/*
+Runs a recurrent layer over the sequence both forwards and backwards, so that every step gets context from
+both sides. Layer should be a fresh (not yet initialized) recurrent layer, and a copy of it with its own
+weights is made to read the sequence in reverse. The reversed copy's outputs are flipped back around so each
+step lines up with the forward one, and then the two are joined step by step; by default each step's outputs
+are concatenated (forward first), and if Sum is set they are added together instead.
+
+The Layer can output its whole sequence or just its last hidden state, but not only its last few steps
+through OutputChunks; the reversed copy's last steps are the first steps of the sequence, so the two
+directions wouldn't line up.
+*/
+type BidirectionalLayer struct {
+	Layer RecurrentLayer
+	Sum   bool
+
+	backward RecurrentLayer
+}
+
+func (layer *BidirectionalLayer) Initialize(n_inputs int) {
+	if layer.Layer == nil {
+		panic("Give your BidirectionalLayer a recurrent Layer to run in both directions!")
+	}
+	if outputChunks(layer.Layer) > 0 {
+		panic("A BidirectionalLayer can't line up the last OutputChunks steps of both directions! Output the whole sequence instead.")
+	}
+
+	// Copy the settings of the layer before it is initialized, so the copy gets weights of its own.
+	if layer.backward == nil {
+		copied := reflect.New(reflect.TypeOf(layer.Layer).Elem())
+		copied.Elem().Set(reflect.ValueOf(layer.Layer).Elem())
+		layer.backward = copied.Interface().(RecurrentLayer)
+	}
+
+	layer.Layer.Initialize(n_inputs)
+	layer.backward.Initialize(n_inputs)
+}
+
+// Gets how many of its last steps the recurrent layer outputs, which is zero if it outputs all of them or just its last hidden state.
+func outputChunks(layer RecurrentLayer) int {
+	switch recurrent := layer.(type) {
+	case *LSTMLayer:
+		return utils.BoolToInt(recurrent.OutputSequence) * recurrent.OutputChunks
+	case *GRULayer:
+		return utils.BoolToInt(recurrent.OutputSequence) * recurrent.OutputChunks
+	}
+	return 0
+}
+
+// Flips the order of the chunks in each column, leaving the values within each chunk where they are.
+func reverseChunks(input *mat.Dense, chunkSize int) *mat.Dense {
+	rows, cols := input.Dims()
+	reversed := mat.NewDense(rows, cols, nil)
+	for i := 0; i < rows; i += chunkSize {
+		reversed.Slice(rows-i-chunkSize, rows-i, 0, cols).(*mat.Dense).Copy(input.Slice(i, i+chunkSize, 0, cols))
+	}
+	return reversed
+}
+
+func (layer *BidirectionalLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	inputSize, outputSize := layer.Layer.ChunkSizes()
+
+	forwardOutput, forwardCache := layer.Layer.Pass(input)
+	backwardOutput, backwardCache := layer.backward.Pass(reverseChunks(input, inputSize))
+	backwardOutput = reverseChunks(backwardOutput, outputSize)
+
+	cache := &BidirectionalCache{ForwardCache: forwardCache, BackwardCache: backwardCache}
+	if layer.Sum {
+		backwardOutput.Add(backwardOutput, forwardOutput)
+		return backwardOutput, cache
+	}
+
+	rows, batchSize := forwardOutput.Dims()
+	output := mat.NewDense(rows*2, batchSize, nil)
+	for i := 0; i < rows; i += outputSize {
+		output.Slice(i*2, i*2+outputSize, 0, batchSize).(*mat.Dense).Copy(forwardOutput.Slice(i, i+outputSize, 0, batchSize))
+		output.Slice(i*2+outputSize, (i+outputSize)*2, 0, batchSize).(*mat.Dense).Copy(backwardOutput.Slice(i, i+outputSize, 0, batchSize))
+	}
+	return output, cache
+}
+
+func (layer *BidirectionalLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	bidirectionalCache := cache.(*BidirectionalCache)
+	inputSize, outputSize := layer.Layer.ChunkSizes()
+
+	// Split the gradients back up between the two directions, undoing however they were joined.
+	forwardSideGradients, backwardSideGradients := forwardGradients, mat.DenseCopyOf(forwardGradients)
+	if !layer.Sum {
+		rows, batchSize := forwardGradients.Dims()
+		forwardSideGradients, backwardSideGradients = mat.NewDense(rows/2, batchSize, nil), mat.NewDense(rows/2, batchSize, nil)
+		for i := 0; i < rows/2; i += outputSize {
+			forwardSideGradients.Slice(i, i+outputSize, 0, batchSize).(*mat.Dense).Copy(forwardGradients.Slice(i*2, i*2+outputSize, 0, batchSize))
+			backwardSideGradients.Slice(i, i+outputSize, 0, batchSize).(*mat.Dense).Copy(forwardGradients.Slice(i*2+outputSize, (i+outputSize)*2, 0, batchSize))
+		}
+	}
+
+	forwardShift, forwardPassback := layer.Layer.Back(bidirectionalCache.ForwardCache, forwardSideGradients)
+	backwardShift, backwardPassback := layer.backward.Back(bidirectionalCache.BackwardCache, reverseChunks(backwardSideGradients, outputSize))
+
+	backwardPassback = reverseChunks(backwardPassback, inputSize)
+	backwardPassback.Add(backwardPassback, forwardPassback)
+	return &BidirectionalShift{forwardShift: forwardShift, backwardShift: backwardShift}, backwardPassback
+}
+
+func (layer *BidirectionalLayer) SetTraining(training bool) {
+	SetTraining([]Layer{layer.Layer, layer.backward}, training)
+}
+
+func (layer *BidirectionalLayer) Penalty() float64 {
+	penalty := 0.0
+	for _, inner := range []Layer{layer.Layer, layer.backward} {
+		if regularized, ok := inner.(Regularized); ok {
+			penalty += regularized.Penalty()
+		}
+	}
+	return penalty
+}
+
+func (layer *BidirectionalLayer) NumOutputs() int {
+	outputs := layer.Layer.NumOutputs()
+	if layer.Sum || outputs < 0 {
+		return outputs
+	}
+	return outputs * 2
+}
+
+func (layer *BidirectionalLayer) NumParameters() int {
+	return NumParameters([]Layer{layer.Layer, layer.backward})
+}
+
+func (layer *BidirectionalLayer) ToBytes() []byte {
+	forwardBytes, backwardBytes := layer.Layer.ToBytes(), layer.backward.ToBytes()
+
+	bytes := save.ConstantsToBytes(utils.BoolToInt(layer.Sum), LayerToIndex(layer.Layer), len(forwardBytes))
+	bytes = append(bytes, forwardBytes...)
+	return append(bytes, backwardBytes...)
+}
+
+func (layer *BidirectionalLayer) FromBytes(bytes []byte) {
+	constants, bytes := save.ConstantsFromBytes(bytes[:12]), bytes[12:]
+	layer.Sum = constants[0] != 0
+
+	layer.Layer, layer.backward = IndexToLayer(constants[1]).(RecurrentLayer), IndexToLayer(constants[1]).(RecurrentLayer)
+	layer.Layer.FromBytes(bytes[:constants[2]])
+	layer.backward.FromBytes(bytes[constants[2]:])
+}
+
+func (layer *BidirectionalLayer) PrettyPrint() string {
+	joined := "Concatenated"
+	if layer.Sum {
+		joined = "Summed"
+	}
+	ret := fmt.Sprintf("Bidirectional Layer (%s)\n\n", joined)
+	ret += "\n\nForward:\n" + layer.Layer.PrettyPrint()
+	ret += "\n\nBackward:\n" + layer.backward.PrettyPrint()
+	return ret
+}
+
+/*
+The shift type for Bidirectional Layers, which just holds the shifts for each direction.
+*/
+type BidirectionalShift struct {
+	forwardShift  ShiftType
+	backwardShift ShiftType
+}
+
+func (b *BidirectionalShift) Apply(layer Layer, scale float64) {
+	bidirectionalLayer := layer.(*BidirectionalLayer)
+	b.forwardShift.Apply(bidirectionalLayer.Layer, scale)
+	b.backwardShift.Apply(bidirectionalLayer.backward, scale)
+}
+
+func (b *BidirectionalShift) Combine(b2 ShiftType) ShiftType {
+	bidirectional2 := b2.(*BidirectionalShift)
+	b.forwardShift = b.forwardShift.Combine(bidirectional2.forwardShift)
+	b.backwardShift = b.backwardShift.Combine(bidirectional2.backwardShift)
+	return b
+}
+
+func (b *BidirectionalShift) Optimize(opt optimizers.Optimizer, index int) {
+	b.forwardShift.Optimize(opt, index)
+	b.backwardShift.Optimize(opt, index+b.forwardShift.NumMatrices())
+}
+
+func (b *BidirectionalShift) NumMatrices() int {
+	return b.forwardShift.NumMatrices() + b.backwardShift.NumMatrices()
+}
+
+func (b *BidirectionalShift) Scale(f float64) {
+	b.forwardShift.Scale(f)
+	b.backwardShift.Scale(f)
+}
+
+func (b *BidirectionalShift) SquaredNorm() float64 {
+	return b.forwardShift.SquaredNorm() + b.backwardShift.SquaredNorm()
+}
+
+func (b *BidirectionalShift) Clip(limit float64) {
+	b.forwardShift.Clip(limit)
+	b.backwardShift.Clip(limit)
+}
@@ -0,0 +1,207 @@
+package layers
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+A 1D convolution over a sequence, laid out just like the inputs of an LSTMLayer or VariableLinearLayer; each
+datapoint is a series of steps, each one a chunk of InChannels values. Every output step is made by sliding a kernel
+KernelWidth steps wide along the sequence, which mixes all of the InChannels of each step it covers into OutChannels
+new ones, so the output is again a series of chunks, OutChannels long.
+
+Stride, Dilation, Padding and PaddingWidth work like they do for a Conv2DLayer, only along the sequence; "same"
+padding keeps the sequence the same length (divided by the Stride), and "explicit" padding adds PaddingWidth empty
+steps to either end. Since the sequences can be any length, the NumOutputs is only known if ConstantLengthInput is
+set, in which case the layer expects to always be given the same number of steps it was initialized with. A sequence
+too short for the (dilated and padded) kernel to fit on it even once is rejected, since it would have no output steps.
+*/
+type Conv1DLayer struct {
+	InChannels  int
+	OutChannels int
+	KernelWidth int
+
+	Stride       int
+	Dilation     int
+	Padding      string
+	PaddingWidth int
+
+	ConstantLengthInput bool
+	inputLength         int
+
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
+	kernels []*mat.Dense
+	biases  *mat.Dense
+}
+
+func (layer *Conv1DLayer) Initialize(numInputs int) {
+	if layer.ConstantLengthInput {
+		layer.inputLength = numInputs
+	}
+
+	if layer.Stride == 0 {
+		layer.Stride = 1
+	}
+	if layer.Dilation == 0 {
+		layer.Dilation = 1
+	}
+	if layer.Padding == "" {
+		layer.Padding = ValidPadding
+	}
+
+	if layer.kernels != nil {
+		return
+	}
+	if layer.InChannels == 0 {
+		panic("You must specify how many InChannels are in each step going into a Conv1DLayer!")
+	}
+	if layer.OutChannels == 0 {
+		panic("You must specify how many OutChannels a Conv1DLayer has!")
+	}
+	if layer.KernelWidth == 0 {
+		panic("You must specify the KernelWidth of a Conv1DLayer!")
+	}
+
+	// Each step of the kernel is its own matrix, mixing the channels of the step it lands on
+	scale := 1 / math.Sqrt(float64(layer.InChannels*layer.KernelWidth))
+	layer.kernels = make([]*mat.Dense, layer.KernelWidth)
+	for k := range layer.kernels {
+		initialWeights := make([]float64, layer.OutChannels*layer.InChannels)
+		for i := range initialWeights {
+			initialWeights[i] = rand.NormFloat64() * scale
+		}
+		layer.kernels[k] = mat.NewDense(layer.OutChannels, layer.InChannels, initialWeights)
+	}
+
+	initialBiases := make([]float64, layer.OutChannels)
+	for i := range initialBiases {
+		initialBiases[i] = rand.NormFloat64() / 15
+	}
+	layer.biases = mat.NewDense(layer.OutChannels, 1, initialBiases)
+}
+
+// Lines the kernel up with a sequence of the given number of steps, treating it as a convolution over a single row.
+func (layer *Conv1DLayer) geometry(steps int) convGeometry {
+	return newSequenceGeometry("Conv1DLayer", steps, layer.KernelWidth, layer.Stride, layer.Dilation, layer.Padding, layer.PaddingWidth)
+}
+
+func (layer *Conv1DLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	inputRows, batchSize := input.Dims()
+	geometry := layer.geometry(inputRows / layer.InChannels)
+	output := mat.NewDense(geometry.output.Cols*layer.OutChannels, batchSize, nil)
+
+	// Each step of the kernel maps an input step onto an output step for the whole batch at once
+	stepOutput := mat.NewDense(layer.OutChannels, batchSize, nil)
+	geometry.forEach(func(o, k, i int) {
+		stepOutput.Mul(layer.kernels[k], input.Slice(i*layer.InChannels, (i+1)*layer.InChannels, 0, batchSize))
+		outputChunk := output.Slice(o*layer.OutChannels, (o+1)*layer.OutChannels, 0, batchSize).(*mat.Dense)
+		outputChunk.Add(outputChunk, stepOutput)
+	})
+
+	for o := 0; o < geometry.output.Cols; o++ {
+		utils.AddToColumns(output.Slice(o*layer.OutChannels, (o+1)*layer.OutChannels, 0, batchSize).(*mat.Dense), layer.biases)
+	}
+
+	return output, &InputCache{Input: input}
+}
+
+func (layer *Conv1DLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	inputs := cache.(*InputCache).Input
+	inputRows, batchSize := inputs.Dims()
+	geometry := layer.geometry(inputRows / layer.InChannels)
+
+	allShifts := make([]*mat.Dense, layer.KernelWidth)
+	for k := range allShifts {
+		allShifts[k] = mat.NewDense(layer.OutChannels, layer.InChannels, nil)
+	}
+	biasShift := mat.NewDense(layer.OutChannels, 1, nil)
+	for o := 0; o < geometry.output.Cols; o++ {
+		biasShift.Add(biasShift, utils.SumColumns(forwardGradients.Slice(o*layer.OutChannels, (o+1)*layer.OutChannels, 0, batchSize).(*mat.Dense)))
+	}
+
+	passback := mat.NewDense(inputRows, batchSize, nil)
+	stepShift, stepPassback := mat.NewDense(layer.OutChannels, layer.InChannels, nil), mat.NewDense(layer.InChannels, batchSize, nil)
+	geometry.forEach(func(o, k, i int) {
+		inputChunk := inputs.Slice(i*layer.InChannels, (i+1)*layer.InChannels, 0, batchSize)
+		gradientChunk := forwardGradients.Slice(o*layer.OutChannels, (o+1)*layer.OutChannels, 0, batchSize)
+
+		stepShift.Mul(gradientChunk, inputChunk.T())
+		allShifts[k].Add(allShifts[k], stepShift)
+
+		stepPassback.Mul(layer.kernels[k].T(), gradientChunk)
+		passbackChunk := passback.Slice(i*layer.InChannels, (i+1)*layer.InChannels, 0, batchSize).(*mat.Dense)
+		passbackChunk.Add(passbackChunk, stepPassback)
+	})
+
+	if !layer.DecoupledDecay {
+		for k, kernel := range layer.kernels {
+			addPenaltyGradient(allShifts[k], kernel, layer.L1, layer.L2, float64(batchSize))
+		}
+	}
+
+	return &KernelShift{shifts: allShifts, biases: biasShift}, passback
+}
+
+func (layer *Conv1DLayer) Penalty() float64 {
+	penalty := 0.0
+	for _, kernel := range layer.kernels {
+		penalty += weightPenalty(kernel, layer.L1, layer.L2)
+	}
+	return penalty
+}
+
+func (layer *Conv1DLayer) NumOutputs() int {
+	if layer.ConstantLengthInput {
+		return layer.geometry(layer.inputLength/layer.InChannels).output.Cols * layer.OutChannels
+	}
+	return -1
+}
+
+func (layer *Conv1DLayer) NumParameters() int {
+	return countParameters(layer.kernels...) + countParameters(layer.biases)
+}
+
+func (layer *Conv1DLayer) ToBytes() []byte {
+	saveBytes := save.ConstantsToBytes(
+		layer.InChannels, layer.OutChannels, layer.KernelWidth, layer.Stride, layer.Dilation,
+		paddingToIndex(layer.Padding), layer.PaddingWidth, utils.BoolToInt(layer.ConstantLengthInput),
+	)
+	for _, kernel := range layer.kernels {
+		saveBytes = append(saveBytes, save.ToBytes(utils.GetSlice(kernel))...)
+	}
+	return append(saveBytes, save.ToBytes(utils.GetSlice(layer.biases))...)
+}
+
+func (layer *Conv1DLayer) FromBytes(bytes []byte) {
+	constInts, weightSlice := save.ConstantsFromBytes(bytes[:32]), save.FromBytes(bytes[32:])
+	layer.InChannels, layer.OutChannels, layer.KernelWidth = constInts[0], constInts[1], constInts[2]
+	layer.Stride, layer.Dilation, layer.Padding, layer.PaddingWidth = constInts[3], constInts[4], indexToPadding(constInts[5]), constInts[6]
+	layer.ConstantLengthInput = constInts[7] != 0
+
+	kernelSize := layer.OutChannels * layer.InChannels
+	layer.kernels = make([]*mat.Dense, layer.KernelWidth)
+	for k := range layer.kernels {
+		layer.kernels[k] = mat.NewDense(layer.OutChannels, layer.InChannels, weightSlice[k*kernelSize:(k+1)*kernelSize])
+	}
+	layer.biases = mat.NewDense(layer.OutChannels, 1, weightSlice[layer.KernelWidth*kernelSize:])
+}
+
+func (layer *Conv1DLayer) PrettyPrint() string {
+	ret := fmt.Sprintf("Conv1D Layer\n%d -> %d channels, kernel width %d\n", layer.InChannels, layer.OutChannels, layer.KernelWidth)
+	ret += fmt.Sprintf("Stride %d, Dilation %d, %s padding\n\n", layer.Stride, layer.Dilation, layer.Padding)
+	for k, kernel := range layer.kernels {
+		ret += fmt.Sprintln("Kernel step", k, "=")
+		ret += fmt.Sprintln(utils.JSify(kernel))
+	}
+	return ret + fmt.Sprintf("biases =\n%s\n", utils.JSify(layer.biases))
+}
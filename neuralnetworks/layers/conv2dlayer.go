@@ -2,6 +2,7 @@ package layers
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 
 	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
@@ -10,21 +11,62 @@ import (
 	"gonum.org/v1/gonum/mat"
 )
 
+/*
+A 2D convolutional layer, where each input channel of InputShape is convolved with NumKernels / (number of input
+channels) kernels of KernelShape, each of which makes an output channel of its own.
+
+If OutChannels is set instead, it works like a standard CNN layer; each of the OutChannels filters has a kernel for
+every one of the InChannels input channels (which defaults to however many channels are coming in), and the results
+of those kernels are summed together into one output channel. This lets the channels mix, which the one kernel per
+input channel layout above can't do.
+
+To keep that from getting too big, the channels can be split into Groups (1 by default) that are convolved on their
+own, so each filter only has kernels for the InChannels / Groups input channels in its group, and the OutChannels
+are split evenly between the groups. Setting Depthwise puts every input channel in a group of its own (with
+OutChannels defaulting to InChannels), which is the same as the NumKernels layout, and a KernelShape of 1x1 makes a
+pointwise convolution, which only mixes the channels; a depthwise layer followed by a pointwise one is a much smaller
+stand-in for a regular convolution, like in MobileNet.
+
+Either way, the kernels move Stride values at a time (1 by default), read every Dilation'th value (1 by default,
+which reads every value), and the input can be padded with zeros according to Padding, which is "valid" (no padding)
+by default; see ValidPadding and the rest. Backend picks how the convolutions are computed, either DirectBackend
+(the default) or the faster Im2ColBackend.
+*/
 type Conv2DLayer struct {
 	InputShape  Shape
 	KernelShape Shape
 	NumKernels  int
 	FirstLayer  bool
 
+	InChannels  int
+	OutChannels int
+	Groups      int
+	Depthwise   bool
+
+	Stride       int
+	Dilation     int
+	Padding      string
+	PaddingShape Shape
+
+	Backend string
+
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
 	kernels         []*mat.Dense
 	biases          *mat.Dense
 	inputMatrices   int
 	inputLen        int
 	kernelsPerInput int
+	geometry        convGeometry
 	outputShape     Shape
 	outputLen       int
 }
 
+// The version of the byte layout written by ToBytes, after a leading zero that older saves never start with.
+const conv2DSaveVersion = 4
+
 func (layer *Conv2DLayer) Initialize(numInputs int) {
 	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
 		fmt.Println("You must specify the InputShape for a Conv2DLayer!")
@@ -36,121 +78,383 @@ func (layer *Conv2DLayer) Initialize(numInputs int) {
 		panic(1)
 	}
 
-	if layer.NumKernels == 0 {
-		fmt.Println("You must specify the NumKernels for a Conv2DLayer!")
-		panic(1)
-	}
-
 	// Computing useful constants for consistent use
 	layer.inputMatrices = numInputs / (layer.InputShape.Rows * layer.InputShape.Cols)
-	layer.kernelsPerInput = layer.NumKernels / layer.inputMatrices
 	layer.inputLen = layer.InputShape.Rows * layer.InputShape.Cols
 
-	if layer.NumKernels%layer.inputMatrices != 0 {
-		fmt.Printf("%d outputs from the last layer does not divide the expected %d inputs! (%dx%dx%d)\n", numInputs, layer.NumKernels*layer.InputShape.Rows*layer.InputShape.Cols, layer.NumKernels, layer.InputShape.Rows, layer.InputShape.Cols)
+	if layer.Depthwise {
+		if layer.InChannels == 0 {
+			layer.InChannels = layer.inputMatrices
+		}
+		if layer.OutChannels == 0 {
+			layer.OutChannels = layer.InChannels
+		}
+		layer.Groups = layer.InChannels
+	}
+
+	if layer.NumKernels == 0 && layer.OutChannels == 0 {
+		fmt.Println("You must specify the NumKernels (or the OutChannels) for a Conv2DLayer!")
 		panic(1)
 	}
 
-	layer.outputShape = Shape{
-		Rows: layer.InputShape.Rows - layer.KernelShape.Rows + 1,
-		Cols: layer.InputShape.Cols - layer.KernelShape.Cols + 1,
+	if layer.OutChannels > 0 {
+		if layer.InChannels == 0 {
+			layer.InChannels = layer.inputMatrices
+		}
+		if layer.InChannels*layer.inputLen != numInputs {
+			fmt.Printf("%d outputs from the last layer aren't the expected %d inputs! (%dx%dx%d)\n", numInputs, layer.InChannels*layer.inputLen, layer.InChannels, layer.InputShape.Rows, layer.InputShape.Cols)
+			panic(1)
+		}
+		if layer.Groups == 0 {
+			layer.Groups = 1
+		}
+		if layer.InChannels%layer.Groups != 0 || layer.OutChannels%layer.Groups != 0 {
+			fmt.Printf("%d input channels and %d output channels can't be split evenly into %d groups!\n", layer.InChannels, layer.OutChannels, layer.Groups)
+			panic(1)
+		}
+	} else {
+		layer.kernelsPerInput = layer.NumKernels / layer.inputMatrices
+		if layer.NumKernels%layer.inputMatrices != 0 {
+			fmt.Printf("%d outputs from the last layer does not divide the expected %d inputs! (%dx%dx%d)\n", numInputs, layer.NumKernels*layer.InputShape.Rows*layer.InputShape.Cols, layer.NumKernels, layer.InputShape.Rows, layer.InputShape.Cols)
+			panic(1)
+		}
+	}
+
+	switch layer.Backend {
+	case "":
+		layer.Backend = DirectBackend
+	case DirectBackend, Im2ColBackend:
+	default:
+		fmt.Printf("\"%s\" isn't a Conv2DLayer backend! Use \"%s\" or \"%s\".\n", layer.Backend, DirectBackend, Im2ColBackend)
+		panic(1)
 	}
-	layer.outputLen = layer.outputShape.Rows * layer.outputShape.Cols
+
+	layer.setGeometry()
 
 	// If the layer has already had it's kernels initialized elsewhere (like from a save file) don't bother populating with randoms
 	if layer.kernels != nil {
 		return
 	}
 
-	// Random Initialization on the kernels
-	layer.kernels = make([]*mat.Dense, layer.NumKernels)
+	// Random Initialization on the kernels; filters summing over many channels get scaled down by how many values they read
+	scale := 1.0 / 15
+	if layer.OutChannels > 0 {
+		scale = 1 / math.Sqrt(float64(layer.InChannels/layer.Groups*layer.KernelShape.Rows*layer.KernelShape.Cols))
+	}
+	layer.kernels = make([]*mat.Dense, layer.numKernels())
 	for i := range layer.kernels {
 		randweights := make([]float64, layer.KernelShape.Rows*layer.KernelShape.Cols)
 		for j := range randweights {
-			randweights[j] = rand.NormFloat64() / 15
+			randweights[j] = rand.NormFloat64() * scale
 		}
 		layer.kernels[i] = mat.NewDense(layer.KernelShape.Rows, layer.KernelShape.Cols, randweights)
 	}
 
 	// Random Initialization on the biases
-	randweights := make([]float64, layer.NumKernels*layer.outputLen)
+	randweights := make([]float64, layer.outputChannels()*layer.outputLen)
 	for j := range randweights {
 		randweights[j] = rand.NormFloat64() / 15
 	}
 
-	layer.biases = mat.NewDense(layer.NumKernels*layer.outputShape.Rows, layer.outputShape.Cols, randweights)
+	layer.biases = mat.NewDense(layer.outputChannels()*layer.outputShape.Rows, layer.outputShape.Cols, randweights)
+
+}
+
+// How many kernels the layer has in total.
+func (layer *Conv2DLayer) numKernels() int {
+	if layer.OutChannels > 0 {
+		return layer.OutChannels * layer.InChannels / layer.Groups
+	}
+	return layer.NumKernels
+}
+
+// How many channels the layer outputs.
+func (layer *Conv2DLayer) outputChannels() int {
+	if layer.OutChannels > 0 {
+		return layer.OutChannels
+	}
+	return layer.NumKernels
+}
 
+/*
+Splits the channels into groups that don't share any kernels, giving how many groups there are and how many input
+and output channels are in each. The kernels are stored output channel by output channel, with one kernel for each
+input channel in the group, so each output channel's kernels sit right next to each other.
+*/
+func (layer *Conv2DLayer) channelGroups() (int, int, int) {
+	if layer.OutChannels > 0 {
+		return layer.Groups, layer.InChannels / layer.Groups, layer.OutChannels / layer.Groups
+	}
+	return layer.inputMatrices, 1, layer.kernelsPerInput
+}
+
+// Gets which input channel the j'th kernel reads from, and which output channel it adds onto.
+func (layer *Conv2DLayer) kernelChannels(j int) (int, int) {
+	_, groupInputs, groupOutputs := layer.channelGroups()
+	o := j / groupInputs
+	return (o/groupOutputs)*groupInputs + j%groupInputs, o
+}
+
+// Fills in the default stride and dilation, then works out the padding and output shape from them.
+func (layer *Conv2DLayer) setGeometry() {
+	if layer.Stride == 0 {
+		layer.Stride = 1
+	}
+	if layer.Dilation == 0 {
+		layer.Dilation = 1
+	}
+	if layer.Padding == "" {
+		layer.Padding = ValidPadding
+	}
+
+	layer.geometry = newConvGeometry(layer.InputShape, layer.KernelShape, Shape{Rows: layer.Stride, Cols: layer.Stride}, layer.Dilation, layer.Padding, layer.PaddingShape)
+	layer.outputShape = layer.geometry.output
+	layer.outputLen = layer.outputShape.Rows * layer.outputShape.Cols
 }
 
 func (layer *Conv2DLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
-	passingSlice := make([]float64, 0)
-	inputSlice := input.RawMatrix().Data
+	var output *mat.Dense
+	if layer.Backend == Im2ColBackend {
+		output = layer.passIm2Col(input)
+	} else {
+		output = layer.passDirect(input)
+	}
+	utils.AddToColumns(output, layer.biases)
+
+	return output, &InputCache{Input: input}
+}
 
-	for k, kernel := range layer.kernels {
-		inputIndex := k / layer.kernelsPerInput
-		correspondingInput := mat.NewDense(layer.InputShape.Rows, layer.InputShape.Cols, inputSlice[inputIndex*layer.inputLen:(inputIndex+1)*layer.inputLen])
+func (layer *Conv2DLayer) passDirect(input *mat.Dense) *mat.Dense {
+	_, batchSize := input.Dims()
+	output := mat.NewDense(layer.NumOutputs(), batchSize, nil)
 
-		convolution := utils.ConvolveNoPadding(correspondingInput, kernel)
-		passingSlice = append(passingSlice, utils.GetSlice(convolution)...)
+	// Each column of the input is its own datapoint, with its input matrices stacked on top of each other
+	for b := 0; b < batchSize; b++ {
+		passingSlice := make([]float64, layer.NumOutputs())
+		inputSlice := mat.Col(nil, b, input)
+
+		for j, kernel := range layer.kernels {
+			i, o := layer.kernelChannels(j)
+			layer.geometry.convolve(inputSlice[i*layer.inputLen:(i+1)*layer.inputLen], utils.GetSlice(kernel), passingSlice[o*layer.outputLen:(o+1)*layer.outputLen])
+		}
+		output.SetCol(b, passingSlice)
 	}
 
-	convolvedOutputs := mat.NewDense(layer.NumKernels*layer.outputShape.Rows, layer.outputShape.Cols, passingSlice)
-	convolvedOutputs.Add(convolvedOutputs, layer.biases)
+	return output
+}
+
+func (layer *Conv2DLayer) passIm2Col(input *mat.Dense) *mat.Dense {
+	_, batchSize := input.Dims()
+	output := mat.NewDense(layer.NumOutputs(), batchSize, nil)
 
-	return mat.NewDense(layer.NumKernels*layer.outputShape.Rows, layer.outputShape.Cols, passingSlice), &InputCache{Input: input}
+	// Each group of channels gets convolved over the whole batch at once
+	for g, columns := range layer.im2colColumns(input) {
+		convolved := &mat.Dense{}
+		convolved.Mul(layer.groupKernels(g), columns)
+		layer.groupToOutputs(convolved, g, output)
+	}
+
+	return output
 }
 
 func (layer *Conv2DLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
-	allShifts := make([]*mat.Dense, layer.NumKernels)
-	inputSlice := utils.GetSlice(cache.(*InputCache).Input)
-
-	biasShift := utils.DenseLike(forwardGradients)
-	biasShift.Copy(forwardGradients)
-	gradientSlice := utils.GetSlice(forwardGradients)
+	inputs := cache.(*InputCache).Input
+	_, batchSize := inputs.Dims()
+
+	var allShifts []*mat.Dense
+	var passback *mat.Dense
+	if layer.Backend == Im2ColBackend {
+		allShifts, passback = layer.backIm2Col(inputs, forwardGradients)
+	} else {
+		allShifts, passback = layer.backDirect(inputs, forwardGradients)
+	}
 
-	// Calculate the shifts for the local kernels
-	for i := 0; i < layer.inputMatrices; i++ {
-		inputMat := mat.NewDense(layer.InputShape.Rows, layer.InputShape.Cols, inputSlice[i*layer.inputLen:(i+1)*layer.inputLen])
-		for k := 0; k < layer.kernelsPerInput; k++ {
-			j := i*layer.kernelsPerInput + k
-			correspondingGradient := mat.NewDense(layer.outputShape.Rows, layer.outputShape.Cols, gradientSlice[j*layer.outputLen:(j+1)*layer.outputLen])
+	biasRows, biasCols := layer.biases.Dims()
+	biasShift := mat.NewDense(biasRows, biasCols, utils.GetSlice(utils.SumColumns(forwardGradients)))
 
-			allShifts[j] = utils.ConvolveNoPadding(inputMat, correspondingGradient)
+	if !layer.DecoupledDecay {
+		for j, kernel := range layer.kernels {
+			addPenaltyGradient(allShifts[j], kernel, layer.L1, layer.L2, float64(batchSize))
 		}
 	}
 
 	if layer.FirstLayer {
 		return &KernelShift{shifts: allShifts, biases: biasShift}, nil
 	}
+	return &KernelShift{shifts: allShifts, biases: biasShift}, passback
+}
 
-	// Calculate the gradients to pass back
+func (layer *Conv2DLayer) backDirect(inputs *mat.Dense, forwardGradients *mat.Dense) ([]*mat.Dense, *mat.Dense) {
+	inputRows, batchSize := inputs.Dims()
 
-	// Hacky way to avoid doing a whole lot of list appending later; I create a slice, then a bunch of
-	// matrices spaced out along the slice. As the matrices get modified, so does the underlying slice,
-	// then at the end I have a slice containing all the relevant data pre-concatenated.
-	passbackSlice := make([]float64, layer.inputMatrices*layer.inputLen)
-	passbackMatrices := make([]*mat.Dense, layer.inputMatrices)
-	for i := range passbackMatrices {
-		passbackMatrices[i] = mat.NewDense(layer.InputShape.Rows, layer.InputShape.Cols, passbackSlice[i*layer.inputLen:(i+1)*layer.inputLen])
+	allShifts := make([]*mat.Dense, len(layer.kernels))
+	for j := range allShifts {
+		allShifts[j] = mat.NewDense(layer.KernelShape.Rows, layer.KernelShape.Cols, nil)
 	}
 
-	for i, kernel := range layer.kernels {
-		rotatedKernel := mat.NewDense(layer.KernelShape.Rows, layer.KernelShape.Cols, utils.Reverse(kernel.RawMatrix().Data))
-		inputIndex := i / layer.kernelsPerInput
-		correspondingGradient := mat.NewDense(layer.outputShape.Rows, layer.outputShape.Cols, gradientSlice[i*layer.outputLen:(i+1)*layer.outputLen])
+	passback := mat.NewDense(inputRows, batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		inputSlice, gradientSlice := mat.Col(nil, b, inputs), mat.Col(nil, b, forwardGradients)
+
+		// Calculate the shifts for the local kernels
+		for j := range layer.kernels {
+			i, o := layer.kernelChannels(j)
+			layer.geometry.kernelGradient(inputSlice[i*layer.inputLen:(i+1)*layer.inputLen], gradientSlice[o*layer.outputLen:(o+1)*layer.outputLen], utils.GetSlice(allShifts[j]))
+		}
+
+		if layer.FirstLayer {
+			continue
+		}
+
+		// Calculate the gradients to pass back
+		passbackSlice := make([]float64, layer.inputMatrices*layer.inputLen)
+		for j, kernel := range layer.kernels {
+			i, o := layer.kernelChannels(j)
+			layer.geometry.inputGradient(utils.GetSlice(kernel), gradientSlice[o*layer.outputLen:(o+1)*layer.outputLen], passbackSlice[i*layer.inputLen:(i+1)*layer.inputLen])
+		}
+
+		passback.SetCol(b, passbackSlice)
+	}
+
+	return allShifts, passback
+}
+
+func (layer *Conv2DLayer) backIm2Col(inputs *mat.Dense, forwardGradients *mat.Dense) ([]*mat.Dense, *mat.Dense) {
+	inputRows, batchSize := inputs.Dims()
+	_, groupInputs, groupOutputs := layer.channelGroups()
+	kernelSize := layer.KernelShape.Rows * layer.KernelShape.Cols
+
+	allShifts := make([]*mat.Dense, len(layer.kernels))
+	passbackSlices := make([][]float64, batchSize)
+	for b := range passbackSlices {
+		passbackSlices[b] = make([]float64, inputRows)
+	}
+
+	for g, columns := range layer.im2colColumns(inputs) {
+		gradients := layer.outputsToGroup(forwardGradients, g)
+
+		// Each row of the kernel gradients holds an output channel's kernels end to end, just like groupKernels
+		kernelGradients := &mat.Dense{}
+		kernelGradients.Mul(gradients, columns.T())
+		gradientSlice, firstKernel := utils.GetSlice(kernelGradients), g*groupOutputs*groupInputs
+		for j := 0; j < groupOutputs*groupInputs; j++ {
+			allShifts[firstKernel+j] = mat.NewDense(layer.KernelShape.Rows, layer.KernelShape.Cols, gradientSlice[j*kernelSize:(j+1)*kernelSize])
+		}
+
+		if layer.FirstLayer {
+			continue
+		}
+
+		// The gradients of the columns get added back onto every input value they were copied from
+		columnGradients := &mat.Dense{}
+		columnGradients.Mul(layer.groupKernels(g).T(), gradients)
+		for b, passbackSlice := range passbackSlices {
+			for c := 0; c < groupInputs; c++ {
+				i := g*groupInputs + c
+				layer.geometry.col2im(columnGradients, c*kernelSize, b*layer.outputLen, passbackSlice[i*layer.inputLen:(i+1)*layer.inputLen])
+			}
+		}
+	}
+
+	return allShifts, utils.FromColumns(passbackSlices)
+}
+
+// Lays out the input for each group of channels with im2col, with every datapoint's columns one after another.
+func (layer *Conv2DLayer) im2colColumns(inputs *mat.Dense) []*mat.Dense {
+	_, batchSize := inputs.Dims()
+	groups, groupInputs, _ := layer.channelGroups()
+	kernelSize := layer.KernelShape.Rows * layer.KernelShape.Cols
+
+	allColumns := make([]*mat.Dense, groups)
+	for g := range allColumns {
+		allColumns[g] = mat.NewDense(groupInputs*kernelSize, batchSize*layer.outputLen, nil)
+	}
+
+	for b := 0; b < batchSize; b++ {
+		inputSlice := mat.Col(nil, b, inputs)
+		for i := 0; i < layer.inputMatrices; i++ {
+			layer.geometry.im2col(inputSlice[i*layer.inputLen:(i+1)*layer.inputLen], allColumns[i/groupInputs], (i%groupInputs)*kernelSize, b*layer.outputLen)
+		}
+	}
+	return allColumns
+}
+
+// Puts the kernels of a group into the rows of a matrix, one row per output channel, to multiply the im2col columns by.
+func (layer *Conv2DLayer) groupKernels(g int) *mat.Dense {
+	_, groupInputs, groupOutputs := layer.channelGroups()
+	kernelSize := layer.KernelShape.Rows * layer.KernelShape.Cols
+
+	kernels := mat.NewDense(groupOutputs, groupInputs*kernelSize, nil)
+	kernelSlice, firstKernel := utils.GetSlice(kernels), g*groupOutputs*groupInputs
+	for j := 0; j < groupOutputs*groupInputs; j++ {
+		copy(kernelSlice[j*kernelSize:(j+1)*kernelSize], utils.GetSlice(layer.kernels[firstKernel+j]))
+	}
+	return kernels
+}
 
-		passbackMatrices[inputIndex].Add(passbackMatrices[inputIndex], utils.ConvolveWithPadding(correspondingGradient, rotatedKernel))
+/*
+The im2col multiply gives each of a group's output channels as a row, with the datapoints one after another along
+it, while the layer outputs each datapoint as a column; these two move a group's channels between those layouts.
+*/
+func (layer *Conv2DLayer) groupToOutputs(grouped *mat.Dense, g int, outputs *mat.Dense) {
+	_, _, groupOutputs := layer.channelGroups()
+	groupedRaw, outputsRaw := grouped.RawMatrix(), outputs.RawMatrix()
+	for r := 0; r < groupOutputs; r++ {
+		firstRow := (g*groupOutputs + r) * layer.outputLen
+		for b := 0; b < outputsRaw.Cols; b++ {
+			for p := 0; p < layer.outputLen; p++ {
+				outputsRaw.Data[(firstRow+p)*outputsRaw.Stride+b] = groupedRaw.Data[r*groupedRaw.Stride+b*layer.outputLen+p]
+			}
+		}
 	}
+}
 
-	return &KernelShift{shifts: allShifts, biases: biasShift}, mat.NewDense(layer.inputMatrices*layer.InputShape.Rows, layer.InputShape.Cols, passbackSlice)
+func (layer *Conv2DLayer) outputsToGroup(outputs *mat.Dense, g int) *mat.Dense {
+	_, _, groupOutputs := layer.channelGroups()
+	_, batchSize := outputs.Dims()
+	grouped := mat.NewDense(groupOutputs, batchSize*layer.outputLen, nil)
+	groupedRaw, outputsRaw := grouped.RawMatrix(), outputs.RawMatrix()
+	for r := 0; r < groupOutputs; r++ {
+		firstRow := (g*groupOutputs + r) * layer.outputLen
+		for b := 0; b < batchSize; b++ {
+			for p := 0; p < layer.outputLen; p++ {
+				groupedRaw.Data[r*groupedRaw.Stride+b*layer.outputLen+p] = outputsRaw.Data[(firstRow+p)*outputsRaw.Stride+b]
+			}
+		}
+	}
+	return grouped
+}
+
+func (layer *Conv2DLayer) Penalty() float64 {
+	penalty := 0.0
+	for _, kernel := range layer.kernels {
+		penalty += weightPenalty(kernel, layer.L1, layer.L2)
+	}
+	return penalty
 }
 
 func (layer *Conv2DLayer) NumOutputs() int {
-	return layer.NumKernels * layer.outputShape.Rows * layer.outputShape.Cols
+	return layer.outputChannels() * layer.outputLen
+}
+
+func (layer *Conv2DLayer) NumParameters() int {
+	return countParameters(layer.kernels...) + countParameters(layer.biases)
+}
+
+func (layer *Conv2DLayer) OutputShape() Shape {
+	return layer.outputShape
+}
+
+// Lets a Conv2DLayer following another one pick up its InputShape without it being specified.
+func (layer *Conv2DLayer) setInputShape(shape Shape) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = shape
+	}
 }
 
 func (layer *Conv2DLayer) ToBytes() []byte {
-	saveBytes := save.ConstantsToBytes(layer.InputShape.Rows, layer.InputShape.Cols, layer.KernelShape.Rows, layer.KernelShape.Cols, layer.NumKernels)
+	saveBytes := save.ConstantsToBytes(0, conv2DSaveVersion, layer.InputShape.Rows, layer.InputShape.Cols, layer.KernelShape.Rows, layer.KernelShape.Cols, layer.NumKernels)
+	saveBytes = append(saveBytes, save.ConstantsToBytes(layer.Stride, layer.Dilation, paddingToIndex(layer.Padding), layer.PaddingShape.Rows, layer.PaddingShape.Cols, layer.InChannels, layer.OutChannels, backendToIndex(layer.Backend), layer.Groups)...)
 	for _, kernel := range layer.kernels {
 		kernelSlice := utils.GetSlice(kernel)
 		saveBytes = append(saveBytes, save.ToBytes(kernelSlice)...)
@@ -160,28 +464,55 @@ func (layer *Conv2DLayer) ToBytes() []byte {
 }
 
 func (layer *Conv2DLayer) FromBytes(bytes []byte) {
-	constInts, kernelSlice := save.ConstantsFromBytes(bytes[:20]), save.FromBytes(bytes[20:])
+	// Older saves start straight away with the InputShape, and were always unpadded with a stride and dilation of 1.
+	var constInts []int
+	if save.ConstantsFromBytes(bytes[:4])[0] != 0 {
+		constInts, bytes = save.ConstantsFromBytes(bytes[:20]), bytes[20:]
+		layer.Stride, layer.Dilation, layer.Padding = 1, 1, ValidPadding
+	} else {
+		version := save.ConstantsFromBytes(bytes[4:8])[0]
+		if version > conv2DSaveVersion {
+			panic(fmt.Sprintf("This Conv2DLayer was saved with a newer layout (version %d) than this version of the library can read!", version))
+		}
+
+		// Each version added a few more constants onto the end of the one before it.
+		numConstants := map[int]int{1: 10, 2: 12, 3: 13, 4: 14}[version]
+		constInts, bytes = save.ConstantsFromBytes(bytes[8:8+4*numConstants]), bytes[8+4*numConstants:]
+		layer.Stride, layer.Dilation, layer.Padding = constInts[5], constInts[6], indexToPadding(constInts[7])
+		layer.PaddingShape = Shape{Rows: constInts[8], Cols: constInts[9]}
+		if version > 1 {
+			layer.InChannels, layer.OutChannels = constInts[10], constInts[11]
+		}
+		if version > 2 {
+			layer.Backend = indexToBackend(constInts[12])
+		}
+		layer.Groups = 1
+		if version > 3 {
+			layer.Groups = constInts[13]
+		}
+	}
+	kernelSlice := save.FromBytes(bytes)
 
 	layer.InputShape = Shape{Rows: constInts[0], Cols: constInts[1]}
 	layer.KernelShape = Shape{Rows: constInts[2], Cols: constInts[3]}
 	layer.NumKernels = constInts[4]
 
-	layer.kernels = make([]*mat.Dense, layer.NumKernels)
+	layer.kernels = make([]*mat.Dense, layer.numKernels())
 	kernelSize := layer.KernelShape.Rows * layer.KernelShape.Cols
 	for i := range layer.kernels {
 		layer.kernels[i] = mat.NewDense(layer.KernelShape.Rows, layer.KernelShape.Cols, kernelSlice[i*kernelSize:(i+1)*kernelSize])
 	}
 
-	layer.outputShape = Shape{
-		Rows: layer.InputShape.Rows - layer.KernelShape.Rows + 1,
-		Cols: layer.InputShape.Cols - layer.KernelShape.Cols + 1,
-	}
-
-	layer.biases = mat.NewDense(layer.NumKernels*layer.outputShape.Rows, layer.outputShape.Cols, kernelSlice[(layer.NumKernels)*kernelSize:])
+	layer.setGeometry()
+	layer.biases = mat.NewDense(layer.outputChannels()*layer.outputShape.Rows, layer.outputShape.Cols, kernelSlice[len(layer.kernels)*kernelSize:])
 }
 
 func (layer *Conv2DLayer) PrettyPrint() string {
-	ret := fmt.Sprintf("Conv2D Layer\n%d kernels\n%dx%d input\n\n", layer.NumKernels, layer.InputShape.Rows, layer.InputShape.Cols)
+	ret := fmt.Sprintf("Conv2D Layer\n%d kernels\n%dx%d input\n", len(layer.kernels), layer.InputShape.Rows, layer.InputShape.Cols)
+	if layer.OutChannels > 0 {
+		ret += fmt.Sprintf("%d -> %d channels in %d groups\n", layer.InChannels, layer.OutChannels, layer.Groups)
+	}
+	ret += fmt.Sprintf("Stride %d, Dilation %d, %s padding, %s backend\n\n", layer.Stride, layer.Dilation, layer.Padding, layer.Backend)
 	for i, kernel := range layer.kernels {
 		ret += fmt.Sprintln("Kernel", i, "=")
 		ret += fmt.Sprintln(utils.JSify(kernel))
@@ -196,14 +527,28 @@ type KernelShift struct {
 }
 
 func (k *KernelShift) Apply(layer Layer, scale float64) {
-	conv := layer.(*Conv2DLayer)
+	switch l := layer.(type) {
+	case *Conv2DLayer:
+		k.applyTo(l.kernels, l.biases, l.L1, l.L2, l.DecoupledDecay, scale)
+	case *ConvTranspose2DLayer:
+		k.applyTo(l.kernels, l.biases, l.L1, l.L2, l.DecoupledDecay, scale)
+	case *Conv1DLayer:
+		k.applyTo(l.kernels, l.biases, l.L1, l.L2, l.DecoupledDecay, scale)
+	}
+}
+
+func (k *KernelShift) applyTo(kernels []*mat.Dense, biases *mat.Dense, l1 float64, l2 float64, decoupledDecay bool, scale float64) {
 	for i, shift := range k.shifts {
+		if decoupledDecay {
+			decayWeights(kernels[i], l1, l2, scale)
+		}
 		shift.Scale(scale, shift)
-		conv.kernels[i].Add(conv.kernels[i], shift)
+		kernels[i].Add(kernels[i], shift)
 	}
 
-	r, c := conv.biases.Dims()
-	conv.biases.Add(mat.NewDense(r, c, utils.GetSlice(k.biases)), conv.biases)
+	k.biases.Scale(scale, k.biases)
+	r, c := biases.Dims()
+	biases.Add(mat.NewDense(r, c, utils.GetSlice(k.biases)), biases)
 }
 
 func (k *KernelShift) Combine(k2 ShiftType) ShiftType {
@@ -233,3 +578,18 @@ func (k *KernelShift) Scale(f float64) {
 	}
 	k.biases.Scale(f, k.biases)
 }
+
+func (k *KernelShift) SquaredNorm() float64 {
+	norm := utils.SquaredNorm(k.biases)
+	for _, shift := range k.shifts {
+		norm += utils.SquaredNorm(shift)
+	}
+	return norm
+}
+
+func (k *KernelShift) Clip(limit float64) {
+	for _, shift := range k.shifts {
+		utils.ClipValues(shift, limit)
+	}
+	utils.ClipValues(k.biases, limit)
+}
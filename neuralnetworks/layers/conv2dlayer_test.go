@@ -0,0 +1,94 @@
+package layers
+
+import (
+	"math/rand"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Fills a matrix with normally distributed values from the given source, so the tests don't depend on each other.
+func randomDense(random *rand.Rand, rows int, cols int) *mat.Dense {
+	values := make([]float64, rows*cols)
+	for i := range values {
+		values[i] = random.NormFloat64()
+	}
+	return mat.NewDense(rows, cols, values)
+}
+
+func TestConv2DBackendsAgree(t *testing.T) {
+	cases := []struct {
+		name   string
+		inputs int
+		layer  Conv2DLayer
+	}{
+		{"legacy kernels", 2 * 42, Conv2DLayer{InputShape: Shape{7, 6}, KernelShape: Shape{3, 2}, NumKernels: 4}},
+		{"stride", 2 * 42, Conv2DLayer{InputShape: Shape{7, 6}, KernelShape: Shape{3, 2}, OutChannels: 3, Stride: 2}},
+		{"dilation", 2 * 42, Conv2DLayer{InputShape: Shape{7, 6}, KernelShape: Shape{3, 3}, OutChannels: 3, Dilation: 2}},
+		{"same padding", 2 * 42, Conv2DLayer{InputShape: Shape{6, 7}, KernelShape: Shape{3, 3}, OutChannels: 3, Padding: SamePadding, Stride: 2}},
+		{"same padding with dilation", 2 * 42, Conv2DLayer{InputShape: Shape{7, 6}, KernelShape: Shape{3, 3}, OutChannels: 2, Padding: SamePadding, Dilation: 2}},
+		{"explicit padding", 2 * 42, Conv2DLayer{InputShape: Shape{6, 7}, KernelShape: Shape{2, 2}, OutChannels: 2, Padding: ExplicitPadding, PaddingShape: Shape{1, 2}}},
+		{"groups", 4 * 30, Conv2DLayer{InputShape: Shape{6, 5}, KernelShape: Shape{3, 2}, OutChannels: 6, Groups: 2, Stride: 2}},
+		{"depthwise", 4 * 30, Conv2DLayer{InputShape: Shape{6, 5}, KernelShape: Shape{3, 3}, Depthwise: true, OutChannels: 8, Padding: SamePadding, Dilation: 2}},
+		{"regularized", 2 * 42, Conv2DLayer{InputShape: Shape{6, 7}, KernelShape: Shape{3, 3}, OutChannels: 3, L1: 0.05, L2: 0.1}},
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			direct := c.layer
+			direct.Backend = DirectBackend
+			direct.Initialize(c.inputs)
+
+			// The same layer, kernels and all, computed the other way.
+			im2col := direct
+			im2col.Backend = Im2ColBackend
+
+			input := randomDense(random, c.inputs, 3)
+			directOutput, directCache := direct.Pass(mat.DenseCopyOf(input))
+			im2colOutput, im2colCache := im2col.Pass(mat.DenseCopyOf(input))
+			if !mat.EqualApprox(directOutput, im2colOutput, 1e-10) {
+				t.Fatalf("the outputs differ:\ndirect %v\nim2col %v", mat.Formatted(directOutput), mat.Formatted(im2colOutput))
+			}
+
+			rows, cols := directOutput.Dims()
+			gradients := randomDense(random, rows, cols)
+			directShift, directPassback := direct.Back(directCache, mat.DenseCopyOf(gradients))
+			im2colShift, im2colPassback := im2col.Back(im2colCache, mat.DenseCopyOf(gradients))
+			if !mat.EqualApprox(directPassback, im2colPassback, 1e-10) {
+				t.Errorf("the gradients passed back differ:\ndirect %v\nim2col %v", mat.Formatted(directPassback), mat.Formatted(im2colPassback))
+			}
+
+			directKernels, im2colKernels := directShift.(*KernelShift), im2colShift.(*KernelShift)
+			if !mat.EqualApprox(directKernels.biases, im2colKernels.biases, 1e-10) {
+				t.Errorf("the bias shifts differ:\ndirect %v\nim2col %v", mat.Formatted(directKernels.biases), mat.Formatted(im2colKernels.biases))
+			}
+			for k := range directKernels.shifts {
+				if !mat.EqualApprox(directKernels.shifts[k], im2colKernels.shifts[k], 1e-10) {
+					t.Errorf("the shifts of kernel %d differ:\ndirect %v\nim2col %v", k, mat.Formatted(directKernels.shifts[k]), mat.Formatted(im2colKernels.shifts[k]))
+				}
+			}
+		})
+	}
+}
+
+// Passes a batch of 32 28x28 images with 8 channels forwards and backwards through a 3x3 convolution out to 16 channels.
+func benchmarkConv2D(b *testing.B, backend string) {
+	layer := &Conv2DLayer{InputShape: Shape{28, 28}, KernelShape: Shape{3, 3}, OutChannels: 16, Padding: SamePadding, Backend: backend}
+	layer.Initialize(8 * 28 * 28)
+	input := randomDense(rand.New(rand.NewSource(1)), 8*28*28, 32)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		output, cache := layer.Pass(input)
+		layer.Back(cache, output)
+	}
+}
+
+func BenchmarkConv2DDirect(b *testing.B) {
+	benchmarkConv2D(b, DirectBackend)
+}
+
+func BenchmarkConv2DIm2Col(b *testing.B) {
+	benchmarkConv2D(b, Im2ColBackend)
+}
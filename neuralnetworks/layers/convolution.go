@@ -0,0 +1,186 @@
+package layers
+
+import (
+	"fmt"
+
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Convolutions can be padded in a few different ways; "valid" (the default) puts no padding around the input, "same"
+pads it just enough that the output has the same shape as the input (or the input divided by the stride, rounded
+up), and "explicit" pads each side of the input by the given PaddingShape.
+*/
+const (
+	ValidPadding    = "valid"
+	SamePadding     = "same"
+	ExplicitPadding = "explicit"
+)
+
+/*
+Convolutions can be worked out in one of two ways; "direct" (the default) walks every kernel over every input one
+value at a time, while "im2col" copies the values each output position reads into the columns of one big matrix,
+so the whole batch can be convolved with a single matrix multiply. Both give the same results (up to rounding),
+but im2col is usually much faster for layers with many channels, at the cost of holding the extra matrix in memory.
+*/
+const (
+	DirectBackend = "direct"
+	Im2ColBackend = "im2col"
+)
+
+func backendToIndex(backend string) int {
+	if backend == Im2ColBackend {
+		return 1
+	}
+	return 0
+}
+
+func indexToBackend(index int) string {
+	return []string{DirectBackend, Im2ColBackend}[index]
+}
+
+// Turns the padding names into ints and back, for the sake of saving them.
+func paddingToIndex(padding string) int {
+	switch padding {
+	case SamePadding:
+		return 1
+	case ExplicitPadding:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func indexToPadding(index int) string {
+	return []string{ValidPadding, SamePadding, ExplicitPadding}[index]
+}
+
+/*
+Everything needed to line a kernel up with its input for a 2D convolution (which, like everywhere else in this
+library, is really a cross-correlation); the kernel moves stride rows and columns at a time, reads every dilation'th
+value, and the input has padTop and padLeft zeros above and to the left of it (the bottom and right are padded by
+however much it takes to fit the output). Channels are stored row by row as flat slices, and every method adds onto its
+output rather than overwriting it, so that the results of many channels can be summed together.
+*/
+type convGeometry struct {
+	input  Shape
+	kernel Shape
+	output Shape
+
+	stride   Shape
+	dilation int
+	padTop   int
+	padLeft  int
+}
+
+// Works out the padding and output shape of a convolution, panicking if the kernel doesn't fit in the input.
+func newConvGeometry(input Shape, kernel Shape, stride Shape, dilation int, padding string, paddingShape Shape) convGeometry {
+	geometry, fits := fitConvGeometry(input, kernel, stride, dilation, padding, paddingShape)
+	if !fits {
+		dilatedRows, dilatedCols := dilation*(kernel.Rows-1)+1, dilation*(kernel.Cols-1)+1
+		panic(fmt.Sprintf("A %dx%d kernel (dilated to %dx%d) doesn't fit in a %dx%d input!", kernel.Rows, kernel.Cols, dilatedRows, dilatedCols, input.Rows, input.Cols))
+	}
+	return geometry
+}
+
+// Works out the geometry of a convolution along a sequence of steps, panicking if the sequence is too short for even
+// one output step; layerName is used to say which layer it was.
+func newSequenceGeometry(layerName string, steps int, width int, stride int, dilation int, padding string, paddingWidth int) convGeometry {
+	geometry, fits := fitConvGeometry(Shape{Rows: 1, Cols: steps}, Shape{Rows: 1, Cols: width}, Shape{Rows: 1, Cols: stride}, dilation, padding, Shape{Cols: paddingWidth})
+	if !fits {
+		panic(fmt.Sprintf("A sequence of %d steps is too short for a %s that reads %d steps at a time, so it would have no output steps! Use longer sequences, or pad them.", steps, layerName, dilation*(width-1)+1))
+	}
+	return geometry
+}
+
+// Works out the padding and output shape of a convolution, and whether the kernel fits in the (padded) input at all.
+func fitConvGeometry(input Shape, kernel Shape, stride Shape, dilation int, padding string, paddingShape Shape) (convGeometry, bool) {
+	geometry := convGeometry{input: input, kernel: kernel, stride: stride, dilation: dilation}
+
+	dilatedRows, dilatedCols := dilation*(kernel.Rows-1)+1, dilation*(kernel.Cols-1)+1
+	padRows, padCols := 0, 0
+	switch padding {
+	case "", ValidPadding:
+	case SamePadding:
+		padRows = utils.Max(((input.Rows+stride.Rows-1)/stride.Rows-1)*stride.Rows+dilatedRows-input.Rows, 0)
+		padCols = utils.Max(((input.Cols+stride.Cols-1)/stride.Cols-1)*stride.Cols+dilatedCols-input.Cols, 0)
+	case ExplicitPadding:
+		padRows, padCols = 2*paddingShape.Rows, 2*paddingShape.Cols
+	default:
+		panic(fmt.Sprintf("\"%s\" isn't a kind of padding! Use \"%s\", \"%s\" or \"%s\".", padding, ValidPadding, SamePadding, ExplicitPadding))
+	}
+	geometry.padTop, geometry.padLeft = padRows/2, padCols/2
+
+	if input.Rows+padRows < dilatedRows || input.Cols+padCols < dilatedCols {
+		return geometry, false
+	}
+	geometry.output = Shape{
+		Rows: (input.Rows+padRows-dilatedRows)/stride.Rows + 1,
+		Cols: (input.Cols+padCols-dilatedCols)/stride.Cols + 1,
+	}
+	return geometry, true
+}
+
+// Calls the function for every pairing of an output position with the kernel position and input position it reads.
+func (g convGeometry) forEach(apply func(outputIndex int, kernelIndex int, inputIndex int)) {
+	for r := 0; r < g.output.Rows; r++ {
+		for c := 0; c < g.output.Cols; c++ {
+			for i := 0; i < g.kernel.Rows; i++ {
+				inputRow := r*g.stride.Rows + i*g.dilation - g.padTop
+				if inputRow < 0 || inputRow >= g.input.Rows {
+					continue
+				}
+				for j := 0; j < g.kernel.Cols; j++ {
+					inputCol := c*g.stride.Cols + j*g.dilation - g.padLeft
+					if inputCol < 0 || inputCol >= g.input.Cols {
+						continue
+					}
+					apply(r*g.output.Cols+c, i*g.kernel.Cols+j, inputRow*g.input.Cols+inputCol)
+				}
+			}
+		}
+	}
+}
+
+// Adds the convolution of the input with the kernel onto the output.
+func (g convGeometry) convolve(input []float64, kernel []float64, output []float64) {
+	g.forEach(func(o, k, i int) {
+		output[o] += input[i] * kernel[k]
+	})
+}
+
+// Adds the gradient of the kernel onto kernelGradient, given the gradient of the output.
+func (g convGeometry) kernelGradient(input []float64, outputGradient []float64, kernelGradient []float64) {
+	g.forEach(func(o, k, i int) {
+		kernelGradient[k] += input[i] * outputGradient[o]
+	})
+}
+
+// Adds the gradient of the input onto inputGradient, given the gradient of the output.
+func (g convGeometry) inputGradient(kernel []float64, outputGradient []float64, inputGradient []float64) {
+	g.forEach(func(o, k, i int) {
+		inputGradient[i] += kernel[k] * outputGradient[o]
+	})
+}
+
+/*
+Copies the values the kernel reads from the input into the columns of the matrix, with each output position getting
+its own column (starting at col) and each kernel position getting its own row (starting at row). Anything read from
+the padding is left as it is, so the matrix should start out as zeros.
+*/
+func (g convGeometry) im2col(input []float64, columns *mat.Dense, row int, col int) {
+	raw := columns.RawMatrix()
+	g.forEach(func(o, k, i int) {
+		raw.Data[(row+k)*raw.Stride+col+o] = input[i]
+	})
+}
+
+// The reverse of im2col, which adds each value in the columns back onto the input position it was read from.
+func (g convGeometry) col2im(columns *mat.Dense, row int, col int, input []float64) {
+	raw := columns.RawMatrix()
+	g.forEach(func(o, k, i int) {
+		input[i] += raw.Data[(row+k)*raw.Stride+col+o]
+	})
+}
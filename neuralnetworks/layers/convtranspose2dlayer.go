@@ -0,0 +1,256 @@
+package layers
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+A transposed 2D convolution, which runs a Conv2DLayer backwards to grow its channels instead of shrinking them;
+each input value is multiplied by a kernel of KernelShape, and the results are added onto the output Stride values
+apart. Like a multi-channel Conv2DLayer, each of the OutChannels filters has a kernel for every one of the
+InChannels input channels (which defaults to however many channels are coming in), and the channels come in and
+go out stacked on top of each other, with the InputShape being picked up from a Conv2DLayer (or anything else
+spatial) before it.
+
+Stride, Dilation, Padding and PaddingShape mean the same as they do for the Conv2DLayer this is the reverse of, so
+a ConvTranspose2DLayer with "same" padding outputs channels exactly Stride times bigger than the ones it was given,
+and one with the same settings as a Conv2DLayer gets back to the shape that Conv2DLayer was given (as long as it
+didn't have to drop any rows or columns that didn't fit the stride).
+*/
+type ConvTranspose2DLayer struct {
+	InputShape  Shape
+	KernelShape Shape
+	InChannels  int
+	OutChannels int
+
+	Stride       int
+	Dilation     int
+	Padding      string
+	PaddingShape Shape
+
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
+	kernels     []*mat.Dense
+	biases      *mat.Dense
+	inputLen    int
+	geometry    convGeometry
+	outputShape Shape
+	outputLen   int
+}
+
+func (layer *ConvTranspose2DLayer) Initialize(numInputs int) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		fmt.Println("A ConvTranspose2DLayer needs to come after a Conv2DLayer, or be given an InputShape!")
+		panic(1)
+	}
+
+	if layer.KernelShape.Rows == 0 || layer.KernelShape.Cols == 0 {
+		fmt.Println("You must specify the KernelShape for a ConvTranspose2DLayer!")
+		panic(1)
+	}
+
+	if layer.OutChannels == 0 {
+		fmt.Println("You must specify the OutChannels for a ConvTranspose2DLayer!")
+		panic(1)
+	}
+
+	layer.inputLen = layer.InputShape.Rows * layer.InputShape.Cols
+	if layer.InChannels == 0 {
+		layer.InChannels = numInputs / layer.inputLen
+	}
+	if layer.InChannels*layer.inputLen != numInputs {
+		fmt.Printf("%d outputs from the last layer aren't the expected %d inputs! (%dx%dx%d)\n", numInputs, layer.InChannels*layer.inputLen, layer.InChannels, layer.InputShape.Rows, layer.InputShape.Cols)
+		panic(1)
+	}
+
+	layer.setGeometry()
+
+	// If the layer has already had it's kernels initialized elsewhere (like from a save file) don't bother populating with randoms
+	if layer.kernels != nil {
+		return
+	}
+
+	scale := 1 / math.Sqrt(float64(layer.InChannels*layer.KernelShape.Rows*layer.KernelShape.Cols))
+	layer.kernels = make([]*mat.Dense, layer.OutChannels*layer.InChannels)
+	for i := range layer.kernels {
+		randweights := make([]float64, layer.KernelShape.Rows*layer.KernelShape.Cols)
+		for j := range randweights {
+			randweights[j] = rand.NormFloat64() * scale
+		}
+		layer.kernels[i] = mat.NewDense(layer.KernelShape.Rows, layer.KernelShape.Cols, randweights)
+	}
+
+	randweights := make([]float64, layer.OutChannels*layer.outputLen)
+	for j := range randweights {
+		randweights[j] = rand.NormFloat64() / 15
+	}
+	layer.biases = mat.NewDense(layer.OutChannels*layer.outputShape.Rows, layer.outputShape.Cols, randweights)
+}
+
+/*
+Fills in the default stride, dilation and padding, then works out the output shape, which is whatever shape a
+Conv2DLayer with the same settings would turn into the InputShape. The geometry is that of the convolution going
+from the output back to the input, which this layer runs in reverse.
+*/
+func (layer *ConvTranspose2DLayer) setGeometry() {
+	if layer.Stride == 0 {
+		layer.Stride = 1
+	}
+	if layer.Dilation == 0 {
+		layer.Dilation = 1
+	}
+	if layer.Padding == "" {
+		layer.Padding = ValidPadding
+	}
+
+	dilatedRows, dilatedCols := layer.Dilation*(layer.KernelShape.Rows-1)+1, layer.Dilation*(layer.KernelShape.Cols-1)+1
+	switch layer.Padding {
+	case SamePadding:
+		layer.outputShape = Shape{Rows: layer.InputShape.Rows * layer.Stride, Cols: layer.InputShape.Cols * layer.Stride}
+	case ExplicitPadding:
+		layer.outputShape = Shape{
+			Rows: (layer.InputShape.Rows-1)*layer.Stride + dilatedRows - 2*layer.PaddingShape.Rows,
+			Cols: (layer.InputShape.Cols-1)*layer.Stride + dilatedCols - 2*layer.PaddingShape.Cols,
+		}
+	default:
+		layer.outputShape = Shape{Rows: (layer.InputShape.Rows-1)*layer.Stride + dilatedRows, Cols: (layer.InputShape.Cols-1)*layer.Stride + dilatedCols}
+	}
+	layer.outputLen = layer.outputShape.Rows * layer.outputShape.Cols
+
+	layer.geometry = newConvGeometry(layer.outputShape, layer.KernelShape, Shape{Rows: layer.Stride, Cols: layer.Stride}, layer.Dilation, layer.Padding, layer.PaddingShape)
+	if layer.geometry.output != layer.InputShape {
+		panic(fmt.Sprintf("A ConvTranspose2DLayer can't grow a %dx%d input with this KernelShape, Stride and Padding!", layer.InputShape.Rows, layer.InputShape.Cols))
+	}
+}
+
+// Gets which input channel the j'th kernel reads from, and which output channel it adds onto.
+func (layer *ConvTranspose2DLayer) kernelChannels(j int) (int, int) {
+	return j % layer.InChannels, j / layer.InChannels
+}
+
+func (layer *ConvTranspose2DLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	_, batchSize := input.Dims()
+	output := mat.NewDense(layer.NumOutputs(), batchSize, nil)
+
+	// Spreading each input value out over the output is exactly how a convolution passes its gradients back
+	for b := 0; b < batchSize; b++ {
+		inputSlice, outputSlice := mat.Col(nil, b, input), make([]float64, layer.NumOutputs())
+		for j, kernel := range layer.kernels {
+			i, o := layer.kernelChannels(j)
+			layer.geometry.inputGradient(utils.GetSlice(kernel), inputSlice[i*layer.inputLen:(i+1)*layer.inputLen], outputSlice[o*layer.outputLen:(o+1)*layer.outputLen])
+		}
+		output.SetCol(b, outputSlice)
+	}
+	utils.AddToColumns(output, layer.biases)
+
+	return output, &InputCache{Input: input}
+}
+
+func (layer *ConvTranspose2DLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	inputs := cache.(*InputCache).Input
+	inputRows, batchSize := inputs.Dims()
+
+	allShifts := make([]*mat.Dense, len(layer.kernels))
+	for j := range allShifts {
+		allShifts[j] = mat.NewDense(layer.KernelShape.Rows, layer.KernelShape.Cols, nil)
+	}
+
+	biasRows, biasCols := layer.biases.Dims()
+	biasShift := mat.NewDense(biasRows, biasCols, utils.GetSlice(utils.SumColumns(forwardGradients)))
+
+	// Going backwards through a transposed convolution is just a regular convolution
+	passback := mat.NewDense(inputRows, batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		inputSlice, gradientSlice := mat.Col(nil, b, inputs), mat.Col(nil, b, forwardGradients)
+		passbackSlice := make([]float64, inputRows)
+		for j, kernel := range layer.kernels {
+			i, o := layer.kernelChannels(j)
+			outputGradients := gradientSlice[o*layer.outputLen : (o+1)*layer.outputLen]
+			layer.geometry.kernelGradient(outputGradients, inputSlice[i*layer.inputLen:(i+1)*layer.inputLen], utils.GetSlice(allShifts[j]))
+			layer.geometry.convolve(outputGradients, utils.GetSlice(kernel), passbackSlice[i*layer.inputLen:(i+1)*layer.inputLen])
+		}
+		passback.SetCol(b, passbackSlice)
+	}
+
+	if !layer.DecoupledDecay {
+		for j, kernel := range layer.kernels {
+			addPenaltyGradient(allShifts[j], kernel, layer.L1, layer.L2, float64(batchSize))
+		}
+	}
+
+	return &KernelShift{shifts: allShifts, biases: biasShift}, passback
+}
+
+func (layer *ConvTranspose2DLayer) Penalty() float64 {
+	penalty := 0.0
+	for _, kernel := range layer.kernels {
+		penalty += weightPenalty(kernel, layer.L1, layer.L2)
+	}
+	return penalty
+}
+
+func (layer *ConvTranspose2DLayer) NumOutputs() int {
+	return layer.OutChannels * layer.outputLen
+}
+
+func (layer *ConvTranspose2DLayer) NumParameters() int {
+	return countParameters(layer.kernels...) + countParameters(layer.biases)
+}
+
+func (layer *ConvTranspose2DLayer) OutputShape() Shape {
+	return layer.outputShape
+}
+
+func (layer *ConvTranspose2DLayer) setInputShape(shape Shape) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = shape
+	}
+}
+
+func (layer *ConvTranspose2DLayer) ToBytes() []byte {
+	saveBytes := save.ConstantsToBytes(
+		layer.InputShape.Rows, layer.InputShape.Cols, layer.KernelShape.Rows, layer.KernelShape.Cols, layer.InChannels, layer.OutChannels,
+		layer.Stride, layer.Dilation, paddingToIndex(layer.Padding), layer.PaddingShape.Rows, layer.PaddingShape.Cols,
+	)
+	for _, kernel := range layer.kernels {
+		saveBytes = append(saveBytes, save.ToBytes(utils.GetSlice(kernel))...)
+	}
+	return append(saveBytes, save.ToBytes(utils.GetSlice(layer.biases))...)
+}
+
+func (layer *ConvTranspose2DLayer) FromBytes(bytes []byte) {
+	constInts, kernelSlice := save.ConstantsFromBytes(bytes[:44]), save.FromBytes(bytes[44:])
+	layer.InputShape = Shape{Rows: constInts[0], Cols: constInts[1]}
+	layer.KernelShape = Shape{Rows: constInts[2], Cols: constInts[3]}
+	layer.InChannels, layer.OutChannels = constInts[4], constInts[5]
+	layer.Stride, layer.Dilation, layer.Padding = constInts[6], constInts[7], indexToPadding(constInts[8])
+	layer.PaddingShape = Shape{Rows: constInts[9], Cols: constInts[10]}
+
+	layer.kernels = make([]*mat.Dense, layer.OutChannels*layer.InChannels)
+	kernelSize := layer.KernelShape.Rows * layer.KernelShape.Cols
+	for i := range layer.kernels {
+		layer.kernels[i] = mat.NewDense(layer.KernelShape.Rows, layer.KernelShape.Cols, kernelSlice[i*kernelSize:(i+1)*kernelSize])
+	}
+
+	layer.setGeometry()
+	layer.biases = mat.NewDense(layer.OutChannels*layer.outputShape.Rows, layer.outputShape.Cols, kernelSlice[len(layer.kernels)*kernelSize:])
+}
+
+func (layer *ConvTranspose2DLayer) PrettyPrint() string {
+	ret := fmt.Sprintf("ConvTranspose2D Layer\n%dx%d -> %dx%d\n%d -> %d channels\n", layer.InputShape.Rows, layer.InputShape.Cols, layer.outputShape.Rows, layer.outputShape.Cols, layer.InChannels, layer.OutChannels)
+	ret += fmt.Sprintf("Stride %d, Dilation %d, %s padding\n\n", layer.Stride, layer.Dilation, layer.Padding)
+	for i, kernel := range layer.kernels {
+		ret += fmt.Sprintln("Kernel", i, "=")
+		ret += fmt.Sprintln(utils.JSify(kernel))
+	}
+	return ret
+}
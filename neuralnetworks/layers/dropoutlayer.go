@@ -0,0 +1,74 @@
+package layers
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Randomly zeroes out each input with probability Rate while training, scaling up the ones that are
+kept so that the expected output stays the same (inverted dropout). Outside of training it does
+nothing at all, so evaluating the network stays deterministic.
+*/
+type DropoutLayer struct {
+	Rate float64
+
+	n_inputs int
+	training bool
+}
+
+func (layer *DropoutLayer) Initialize(n_inputs int) {
+	if layer.Rate < 0 || layer.Rate >= 1 {
+		panic(fmt.Sprintf("A DropoutLayer's Rate must be at least 0 and less than 1, not %.2f!", layer.Rate))
+	}
+	layer.n_inputs = n_inputs
+}
+
+func (layer *DropoutLayer) SetTraining(training bool) {
+	layer.training = training
+}
+
+func (layer *DropoutLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	if !layer.training || layer.Rate == 0 {
+		return input, &DropoutCache{}
+	}
+
+	mask := mat.NewDense(input.RawMatrix().Rows, input.RawMatrix().Cols, nil)
+	mask.Apply(func(_, _ int, _ float64) float64 {
+		if rand.Float64() < layer.Rate {
+			return 0
+		}
+		return 1 / (1 - layer.Rate)
+	}, mask)
+
+	output := mat.NewDense(input.RawMatrix().Rows, input.RawMatrix().Cols, nil)
+	output.MulElem(input, mask)
+	return output, &DropoutCache{Mask: mask}
+}
+
+func (layer *DropoutLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	mask := cache.(*DropoutCache).Mask
+	if mask != nil {
+		forwardGradients.MulElem(forwardGradients, mask)
+	}
+	return &NilShift{}, forwardGradients
+}
+
+func (layer *DropoutLayer) NumOutputs() int {
+	return layer.n_inputs
+}
+
+func (layer *DropoutLayer) ToBytes() []byte {
+	return save.ToBytes([]float64{layer.Rate})
+}
+
+func (layer *DropoutLayer) FromBytes(bytes []byte) {
+	layer.Rate = save.FromBytes(bytes)[0]
+}
+
+func (layer *DropoutLayer) PrettyPrint() string {
+	return fmt.Sprintf("Dropout (%.2f)\n", layer.Rate)
+}
@@ -0,0 +1,235 @@
+package layers
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Looks up a learned vector of Dimensions for each token id in the input, and outputs them one after another, so
+each value in the input column turns into a chunk of Dimensions (ready for layers that read InputSize long tokens).
+Ids have to be below VocabSize, and negative ids can be used as padding, which turns into a vector of zeros.
+
+To start from embeddings that were trained ahead of time, like the ones from nlp.OpenEmbeddings, set Pretrained,
+which also sets the VocabSize and Dimensions. The ids given by nlp.Tokenize with nlp.GetMapping(tokens) line up
+with those embeddings. If Frozen is set, the embeddings are left as they are while training.
+
+Only the rows of the tokens that were actually seen get shifted, so training only touches a small part of a big
+vocabulary, but that only holds with GradientDescent. Every other optimizer keeps track of past shifts for the whole
+VocabSize by Dimensions matrix, which can move rows that weren't seen, so with those each step builds and rescales
+the full matrix no matter how few tokens were in the batch.
+*/
+type EmbeddingLayer struct {
+	VocabSize  int
+	Dimensions int
+
+	Pretrained [][]float64
+	Frozen     bool
+
+	embeddings *mat.Dense
+	n_inputs   int
+}
+
+func (layer *EmbeddingLayer) Initialize(n_inputs int) {
+	layer.n_inputs = n_inputs
+
+	if layer.embeddings != nil {
+		return
+	}
+
+	if layer.Pretrained != nil {
+		layer.VocabSize, layer.Dimensions = len(layer.Pretrained), len(layer.Pretrained[0])
+		layer.embeddings = mat.NewDense(layer.VocabSize, layer.Dimensions, nil)
+		for id, embedding := range layer.Pretrained {
+			layer.embeddings.SetRow(id, embedding)
+		}
+		return
+	}
+
+	if layer.VocabSize == 0 {
+		panic("You must specify the VocabSize of an EmbeddingLayer, or give it Pretrained embeddings!")
+	}
+	if layer.Dimensions == 0 {
+		panic("You must specify how many Dimensions an EmbeddingLayer has, or give it Pretrained embeddings!")
+	}
+
+	initialEmbeddings := make([]float64, layer.VocabSize*layer.Dimensions)
+	for i := range initialEmbeddings {
+		initialEmbeddings[i] = rand.NormFloat64() / math.Sqrt(float64(layer.Dimensions))
+	}
+	layer.embeddings = mat.NewDense(layer.VocabSize, layer.Dimensions, initialEmbeddings)
+}
+
+// Gets the token id stored in the input, making sure it has an embedding.
+func (layer *EmbeddingLayer) tokenID(value float64) int {
+	id := int(math.Round(value))
+	if id >= layer.VocabSize {
+		panic(fmt.Sprintf("An EmbeddingLayer with a VocabSize of %d was given the token id %d!", layer.VocabSize, id))
+	}
+	return id
+}
+
+func (layer *EmbeddingLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	numTokens, batchSize := input.Dims()
+	output := mat.NewDense(numTokens*layer.Dimensions, batchSize, nil)
+	for t := 0; t < numTokens; t++ {
+		for b := 0; b < batchSize; b++ {
+			if id := layer.tokenID(input.At(t, b)); id >= 0 {
+				output.Slice(t*layer.Dimensions, (t+1)*layer.Dimensions, b, b+1).(*mat.Dense).Copy(layer.embeddings.RowView(id))
+			}
+		}
+	}
+	return output, &InputCache{Input: input}
+}
+
+func (layer *EmbeddingLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	input := cache.(*InputCache).Input
+	numTokens, batchSize := input.Dims()
+
+	// Token ids can't be nudged, so there's nothing meaningful to pass back.
+	backwardGradients := mat.NewDense(numTokens, batchSize, nil)
+	if layer.Frozen {
+		return &NilShift{}, backwardGradients
+	}
+
+	rowShifts := make(map[int][]float64)
+	for t := 0; t < numTokens; t++ {
+		for b := 0; b < batchSize; b++ {
+			id := layer.tokenID(input.At(t, b))
+			if id < 0 {
+				continue
+			}
+			if rowShifts[id] == nil {
+				rowShifts[id] = make([]float64, layer.Dimensions)
+			}
+			for d := range rowShifts[id] {
+				rowShifts[id][d] += forwardGradients.At(t*layer.Dimensions+d, b)
+			}
+		}
+	}
+	return &EmbeddingShift{rowShifts: rowShifts, vocabSize: layer.VocabSize, dimensions: layer.Dimensions}, backwardGradients
+}
+
+func (layer *EmbeddingLayer) NumOutputs() int {
+	if layer.n_inputs < 0 {
+		return -1
+	}
+	return layer.n_inputs * layer.Dimensions
+}
+
+func (layer *EmbeddingLayer) NumParameters() int {
+	return countParameters(layer.embeddings)
+}
+
+func (layer *EmbeddingLayer) ToBytes() []byte {
+	saveBytes := save.ConstantsToBytes(layer.VocabSize, layer.Dimensions, utils.BoolToInt(layer.Frozen))
+	return append(saveBytes, save.ToBytes(utils.GetSlice(layer.embeddings))...)
+}
+
+func (layer *EmbeddingLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes[:12])
+	layer.VocabSize, layer.Dimensions, layer.Frozen = constInts[0], constInts[1], constInts[2] != 0
+	layer.embeddings = mat.NewDense(layer.VocabSize, layer.Dimensions, save.FromBytes(bytes[12:]))
+}
+
+func (layer *EmbeddingLayer) PrettyPrint() string {
+	frozen := ""
+	if layer.Frozen {
+		frozen = ", Frozen"
+	}
+	return fmt.Sprintf("Embedding Layer\n%d Tokens -> %d Dimensions%s\n\nembeddings =\n%s\n", layer.VocabSize, layer.Dimensions, frozen, utils.JSify(layer.embeddings))
+}
+
+/*
+ShiftType used by EmbeddingLayers, which only holds the rows for tokens that showed up.
+*/
+type EmbeddingShift struct {
+	rowShifts  map[int][]float64
+	vocabSize  int
+	dimensions int
+}
+
+func (e *EmbeddingShift) Apply(layer Layer, scale float64) {
+	embeddings := layer.(*EmbeddingLayer).embeddings
+	for id, rowShift := range e.rowShifts {
+		row := embeddings.RawRowView(id)
+		for d, v := range rowShift {
+			row[d] += v * scale
+		}
+	}
+}
+
+func (e *EmbeddingShift) Combine(e2 ShiftType) ShiftType {
+	for id, rowShift := range e2.(*EmbeddingShift).rowShifts {
+		if e.rowShifts[id] == nil {
+			e.rowShifts[id] = make([]float64, len(rowShift))
+		}
+		for d, v := range rowShift {
+			e.rowShifts[id][d] += v
+		}
+	}
+	return e
+}
+
+func (e *EmbeddingShift) Optimize(opt optimizers.Optimizer, index int) {
+	// Plain gradient descent leaves the shift as it is, so there's no need to build out the whole matrix.
+	if _, ok := opt.(*optimizers.GradientDescent); ok {
+		return
+	}
+
+	// Every other optimizer needs the whole vocabulary's matrix to rescale.
+	dense := mat.NewDense(e.vocabSize, e.dimensions, nil)
+	for id, rowShift := range e.rowShifts {
+		dense.SetRow(id, rowShift)
+	}
+	dense = opt.Rescale(dense, index)
+
+	// Optimizers with memory can shift rows that weren't seen this time, so keep every row that isn't all zeros.
+	e.rowShifts = make(map[int][]float64)
+	for id := 0; id < e.vocabSize; id++ {
+		row := dense.RawRowView(id)
+		for _, v := range row {
+			if v != 0 {
+				e.rowShifts[id] = row
+				break
+			}
+		}
+	}
+}
+
+func (e *EmbeddingShift) NumMatrices() int {
+	return 1
+}
+
+func (e *EmbeddingShift) Scale(f float64) {
+	for _, rowShift := range e.rowShifts {
+		for d := range rowShift {
+			rowShift[d] *= f
+		}
+	}
+}
+
+func (e *EmbeddingShift) SquaredNorm() float64 {
+	norm := 0.0
+	for _, rowShift := range e.rowShifts {
+		for _, v := range rowShift {
+			norm += v * v
+		}
+	}
+	return norm
+}
+
+func (e *EmbeddingShift) Clip(limit float64) {
+	for _, rowShift := range e.rowShifts {
+		for d, v := range rowShift {
+			rowShift[d] = math.Max(-limit, math.Min(limit, v))
+		}
+	}
+}
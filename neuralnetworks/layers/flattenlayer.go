@@ -17,7 +17,8 @@ func (layer *FlattenLayer) Initialize(n_inputs int) {
 }
 
 func (layer *FlattenLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
-	return mat.NewDense(layer.n_inputs, 1, utils.GetSlice(input)), nil
+	inputSlice := utils.GetSlice(input)
+	return mat.NewDense(layer.n_inputs, len(inputSlice)/layer.n_inputs, inputSlice), nil
 }
 
 func (layer *FlattenLayer) Back(_ CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
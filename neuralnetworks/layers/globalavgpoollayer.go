@@ -0,0 +1,90 @@
+package layers
+
+import (
+	"fmt"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Averages each of the channels output by a Conv2DLayer down to a single value, so the output has one value per
+channel no matter how big the channels are. The InputShape is picked up automatically from a Conv2DLayer before
+it, and otherwise the whole datapoint is treated as one channel.
+*/
+type GlobalAvgPoolLayer struct {
+	InputShape Shape
+
+	n_inputs int
+	channels int
+}
+
+func (layer *GlobalAvgPoolLayer) Initialize(n_inputs int) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = Shape{Rows: n_inputs, Cols: 1}
+	}
+
+	if n_inputs%(layer.InputShape.Rows*layer.InputShape.Cols) != 0 {
+		fmt.Printf("%d outputs from the last layer can't be split into %dx%d channels!\n", n_inputs, layer.InputShape.Rows, layer.InputShape.Cols)
+		panic(1)
+	}
+
+	layer.n_inputs = n_inputs
+	layer.channels = n_inputs / (layer.InputShape.Rows * layer.InputShape.Cols)
+}
+
+func (layer *GlobalAvgPoolLayer) setInputShape(shape Shape) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = shape
+	}
+}
+
+func (layer *GlobalAvgPoolLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	_, batchSize := input.Dims()
+	channelSize := layer.InputShape.Rows * layer.InputShape.Cols
+
+	output := mat.NewDense(layer.channels, batchSize, nil)
+	for i := 0; i < layer.n_inputs; i++ {
+		outputRow := output.RawRowView(i / channelSize)
+		for b, v := range input.RawRowView(i) {
+			outputRow[b] += v
+		}
+	}
+	output.Scale(1/float64(channelSize), output)
+	return output, nil
+}
+
+func (layer *GlobalAvgPoolLayer) Back(_ CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	_, batchSize := forwardGradients.Dims()
+	channelSize := layer.InputShape.Rows * layer.InputShape.Cols
+
+	// Every value in a channel gets an even share of its gradient
+	backwardGradients := mat.NewDense(layer.n_inputs, batchSize, nil)
+	for i := 0; i < layer.n_inputs; i++ {
+		backwardGradients.SetRow(i, mat.Row(nil, i/channelSize, forwardGradients))
+	}
+	backwardGradients.Scale(1/float64(channelSize), backwardGradients)
+	return &NilShift{}, backwardGradients
+}
+
+func (layer *GlobalAvgPoolLayer) NumOutputs() int {
+	return layer.channels
+}
+
+func (layer *GlobalAvgPoolLayer) OutputShape() Shape {
+	return Shape{Rows: 1, Cols: 1}
+}
+
+func (layer *GlobalAvgPoolLayer) ToBytes() []byte {
+	return save.ConstantsToBytes(layer.InputShape.Rows, layer.InputShape.Cols)
+}
+
+func (layer *GlobalAvgPoolLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes)
+	layer.InputShape = Shape{Rows: constInts[0], Cols: constInts[1]}
+}
+
+func (layer *GlobalAvgPoolLayer) PrettyPrint() string {
+	return fmt.Sprintf("GlobalAvgPool (%dx%d -> 1x1)\n", layer.InputShape.Rows, layer.InputShape.Cols)
+}
@@ -0,0 +1,107 @@
+package layers
+
+import (
+	"fmt"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Takes the largest value in each of the channels output by a Conv2DLayer, so the output has one value per channel
+no matter how big the channels are. The InputShape is picked up automatically from a Conv2DLayer before it, and
+otherwise the whole datapoint is treated as one channel. The gradient of each output goes back only to the value
+that was picked (the first one, if there's a tie).
+*/
+type GlobalMaxPoolLayer struct {
+	InputShape Shape
+
+	n_inputs int
+	channels int
+}
+
+func (layer *GlobalMaxPoolLayer) Initialize(n_inputs int) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = Shape{Rows: n_inputs, Cols: 1}
+	}
+
+	if n_inputs%(layer.InputShape.Rows*layer.InputShape.Cols) != 0 {
+		fmt.Printf("%d outputs from the last layer can't be split into %dx%d channels!\n", n_inputs, layer.InputShape.Rows, layer.InputShape.Cols)
+		panic(1)
+	}
+
+	layer.n_inputs = n_inputs
+	layer.channels = n_inputs / (layer.InputShape.Rows * layer.InputShape.Cols)
+}
+
+func (layer *GlobalMaxPoolLayer) setInputShape(shape Shape) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = shape
+	}
+}
+
+// Finds which row of the input holds the largest value of each channel, for every datapoint in the batch.
+func (layer *GlobalMaxPoolLayer) maxRows(input *mat.Dense) [][]int {
+	_, batchSize := input.Dims()
+	channelSize := layer.InputShape.Rows * layer.InputShape.Cols
+
+	maxRows := make([][]int, layer.channels)
+	for c := range maxRows {
+		maxRows[c] = make([]int, batchSize)
+		for b := range maxRows[c] {
+			maxRows[c][b] = c * channelSize
+			for i := c*channelSize + 1; i < (c+1)*channelSize; i++ {
+				if input.At(i, b) > input.At(maxRows[c][b], b) {
+					maxRows[c][b] = i
+				}
+			}
+		}
+	}
+	return maxRows
+}
+
+func (layer *GlobalMaxPoolLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	_, batchSize := input.Dims()
+	output := mat.NewDense(layer.channels, batchSize, nil)
+	for c, rows := range layer.maxRows(input) {
+		for b, i := range rows {
+			output.Set(c, b, input.At(i, b))
+		}
+	}
+	return output, &InputCache{Input: input}
+}
+
+func (layer *GlobalMaxPoolLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	input := cache.(*InputCache).Input
+	_, batchSize := input.Dims()
+
+	backwardGradients := mat.NewDense(layer.n_inputs, batchSize, nil)
+	for c, rows := range layer.maxRows(input) {
+		for b, i := range rows {
+			backwardGradients.Set(i, b, forwardGradients.At(c, b))
+		}
+	}
+	return &NilShift{}, backwardGradients
+}
+
+func (layer *GlobalMaxPoolLayer) NumOutputs() int {
+	return layer.channels
+}
+
+func (layer *GlobalMaxPoolLayer) OutputShape() Shape {
+	return Shape{Rows: 1, Cols: 1}
+}
+
+func (layer *GlobalMaxPoolLayer) ToBytes() []byte {
+	return save.ConstantsToBytes(layer.InputShape.Rows, layer.InputShape.Cols)
+}
+
+func (layer *GlobalMaxPoolLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes)
+	layer.InputShape = Shape{Rows: constInts[0], Cols: constInts[1]}
+}
+
+func (layer *GlobalMaxPoolLayer) PrettyPrint() string {
+	return fmt.Sprintf("GlobalMaxPool (%dx%d -> 1x1)\n", layer.InputShape.Rows, layer.InputShape.Cols)
+}
@@ -0,0 +1,344 @@
+package layers
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+A gated recurrent unit, which is a cheaper alternative to an LSTMLayer; it has three gates instead of four,
+and only carries a hidden state from step to step. The input is read in chunks of InputSize, and the other
+settings work just the same as they do for an LSTMLayer.
+*/
+type GRULayer struct {
+	Outputs   int
+	InputSize int
+
+	OutputSequence      bool
+	ConstantLengthInput bool
+	OutputChunks        int
+
+	// Weight penalties on all three gates, counted once per sequence rather than once per step.
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
+	numConcat       int
+	numTotalOutputs int
+
+	updateGate    LinearLayer
+	resetGate     LinearLayer
+	candidateGate LinearLayer
+
+	initialHiddenState *mat.Dense
+}
+
+func (layer *GRULayer) Initialize(totalInputs int) {
+	if layer.Outputs == 0 {
+		panic("Set how many outputs you want in your GRU layer!")
+	}
+	if layer.InputSize == 0 {
+		panic("Set how large each input chuck being passed to your GRU layer is!")
+	}
+
+	layer.numConcat = layer.InputSize + layer.Outputs
+	if layer.ConstantLengthInput {
+		layer.numTotalOutputs = totalInputs / layer.InputSize * layer.Outputs
+	}
+
+	for _, gate := range layer.gates() {
+		gate.Outputs = layer.Outputs
+		gate.Initialize(layer.numConcat)
+	}
+
+	if layer.initialHiddenState == nil {
+		layer.initialHiddenState = mat.NewDense(layer.Outputs, 1, nil)
+	}
+}
+
+func (layer *GRULayer) gates() []*LinearLayer {
+	return []*LinearLayer{&layer.updateGate, &layer.resetGate, &layer.candidateGate}
+}
+
+func (layer *GRULayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	inputRows, batchSize := input.Dims()
+	hiddenState := utils.RepeatColumn(layer.initialHiddenState, batchSize)
+
+	inputs, resetInputs, hiddenStates, updateOutputs, resetOutputs, candidateOutputs := make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0)
+
+	for i := 0; i < inputRows; i += layer.InputSize {
+		inputChunk := mat.DenseCopyOf(input.Slice(i, i+layer.InputSize, 0, batchSize))
+		concatInput := stackChunks([]*mat.Dense{hiddenState, inputChunk})
+		inputs = append(inputs, concatInput)
+
+		// Update and Reset Gates
+		updateOutput := passThroughGate(&layer.updateGate, concatInput, sigmoid)
+		updateOutputs = append(updateOutputs, updateOutput)
+
+		resetOutput := passThroughGate(&layer.resetGate, concatInput, sigmoid)
+		resetOutputs = append(resetOutputs, resetOutput)
+
+		// Candidate Gate, which only sees the part of the hidden state that the reset gate lets through
+		resetHiddenState := utils.DenseLike(hiddenState)
+		resetHiddenState.MulElem(resetOutput, hiddenState)
+		resetInput := stackChunks([]*mat.Dense{resetHiddenState, inputChunk})
+		resetInputs = append(resetInputs, resetInput)
+
+		candidateOutput := passThroughGate(&layer.candidateGate, resetInput, math.Tanh)
+		candidateOutputs = append(candidateOutputs, candidateOutput)
+
+		// Blend the old hidden state with the candidate, keeping as much of the old one as the update gate says to
+		nextHiddenState := utils.DenseLike(hiddenState)
+		nextHiddenState.Apply(func(r, c int, v float64) float64 {
+			update := updateOutput.At(r, c)
+			return update*v + (1-update)*candidateOutput.At(r, c)
+		}, hiddenState)
+		hiddenState = nextHiddenState
+		hiddenStates = append(hiddenStates, hiddenState)
+	}
+
+	layerCache := &GRUCache{
+		Inputs:           inputs,
+		ResetInputs:      resetInputs,
+		HiddenStates:     hiddenStates,
+		UpdateOutputs:    updateOutputs,
+		ResetOutputs:     resetOutputs,
+		CandidateOutputs: candidateOutputs,
+	}
+
+	if layer.OutputSequence && layer.OutputChunks == 0 {
+		return stackChunks(hiddenStates), layerCache
+	} else if layer.OutputSequence {
+		return stackChunks(hiddenStates[len(hiddenStates)-layer.OutputChunks:]), layerCache
+	}
+	return hiddenState, layerCache
+}
+
+func (layer *GRULayer) Back(cache CacheType, frontalPass *mat.Dense) (ShiftType, *mat.Dense) {
+	gruCache := cache.(*GRUCache)
+	inputs, resetInputs, hiddenStates, updateOutputs, resetOutputs, candidateOutputs := gruCache.Inputs, gruCache.ResetInputs, gruCache.HiddenStates, gruCache.UpdateOutputs, gruCache.ResetOutputs, gruCache.CandidateOutputs
+
+	var updateShift, resetShift, candidateShift ShiftType
+	updateShift, resetShift, candidateShift = &NilShift{}, &NilShift{}, &NilShift{}
+
+	// Just like in the LSTMLayer, only the hidden states we output have loss gradients of their own.
+	frontalRows, batchSize := frontalPass.Dims()
+	numGradients := frontalRows / layer.Outputs
+	forwardGradients := make([]*mat.Dense, len(inputs))
+	for i := 0; i < numGradients; i++ {
+		forwardGradients[len(inputs)-numGradients+i] = mat.DenseCopyOf(frontalPass.Slice(i*layer.Outputs, (i+1)*layer.Outputs, 0, batchSize))
+	}
+
+	backwardGradients := mat.NewDense(len(inputs)*layer.InputSize, batchSize, nil)
+
+	hiddenStateGradient := mat.NewDense(layer.Outputs, batchSize, nil)
+	for i := len(inputs) - 1; i >= 0; i-- {
+		if forwardGradients[i] != nil {
+			hiddenStateGradient.Add(hiddenStateGradient, forwardGradients[i])
+		}
+
+		var lastHiddenState *mat.Dense
+		if i == 0 {
+			lastHiddenState = utils.RepeatColumn(layer.initialHiddenState, batchSize)
+		} else {
+			lastHiddenState = hiddenStates[i-1]
+		}
+
+		// Candidate Gate Gradient Calculation
+		candidateGateGradient := utils.DenseLike(hiddenStateGradient)
+		candidateGateGradient.Apply(func(r, c int, v float64) float64 {
+			candidateVal := candidateOutputs[i].At(r, c)
+			return v * (1 - updateOutputs[i].At(r, c)) * (1 - candidateVal*candidateVal)
+		}, hiddenStateGradient)
+		localCandidateShift, candidatePassback := layer.candidateGate.Back(&InputCache{Input: resetInputs[i]}, candidateGateGradient)
+		candidateShift = candidateShift.Combine(localCandidateShift)
+		resetHiddenStateGradient := candidatePassback.Slice(0, layer.Outputs, 0, batchSize)
+
+		// Update Gate Gradient Calculation
+		updateGateGradient := utils.DenseLike(hiddenStateGradient)
+		updateGateGradient.Apply(func(r, c int, v float64) float64 {
+			updateVal := updateOutputs[i].At(r, c)
+			return v * (lastHiddenState.At(r, c) - candidateOutputs[i].At(r, c)) * updateVal * (1 - updateVal)
+		}, hiddenStateGradient)
+		localUpdateShift, updatePassback := layer.updateGate.Back(&InputCache{Input: inputs[i]}, updateGateGradient)
+		updateShift = updateShift.Combine(localUpdateShift)
+
+		// Reset Gate Gradient Calculation
+		resetGateGradient := utils.DenseLike(hiddenStateGradient)
+		resetGateGradient.Apply(func(r, c int, v float64) float64 {
+			resetVal := resetOutputs[i].At(r, c)
+			return v * lastHiddenState.At(r, c) * resetVal * (1 - resetVal)
+		}, resetHiddenStateGradient)
+		localResetShift, resetPassback := layer.resetGate.Back(&InputCache{Input: inputs[i]}, resetGateGradient)
+		resetShift = resetShift.Combine(localResetShift)
+
+		// The last hidden state is reached directly, through the reset gate's product, and through both gates' inputs
+		combinedPassback := utils.DenseLike(updatePassback)
+		combinedPassback.Add(updatePassback, resetPassback)
+
+		lastHiddenStateGradient := utils.DenseLike(hiddenStateGradient)
+		lastHiddenStateGradient.Apply(func(r, c int, v float64) float64 {
+			return v*updateOutputs[i].At(r, c) + resetHiddenStateGradient.At(r, c)*resetOutputs[i].At(r, c) + combinedPassback.At(r, c)
+		}, hiddenStateGradient)
+		hiddenStateGradient = lastHiddenStateGradient
+
+		combinedPassback.Add(combinedPassback, candidatePassback)
+		backwardGradients.Slice(i*layer.InputSize, (i+1)*layer.InputSize, 0, batchSize).(*mat.Dense).Copy(combinedPassback.Slice(layer.Outputs, layer.numConcat, 0, batchSize))
+	}
+
+	if !layer.DecoupledDecay {
+		for i, shift := range []ShiftType{updateShift, resetShift, candidateShift} {
+			if weightShift, ok := shift.(*WeightShift); ok {
+				addPenaltyGradient(weightShift.weightShift, layer.gates()[i].weights, layer.L1, layer.L2, float64(batchSize))
+			}
+		}
+	}
+
+	return &GRUShift{
+		updateShift:      updateShift,
+		resetShift:       resetShift,
+		candidateShift:   candidateShift,
+		hiddenStateShift: utils.SumColumns(hiddenStateGradient),
+	}, backwardGradients
+}
+
+func (layer *GRULayer) Penalty() float64 {
+	penalty := 0.0
+	for _, gate := range layer.gates() {
+		penalty += weightPenalty(gate.weights, layer.L1, layer.L2)
+	}
+	return penalty
+}
+
+func (layer *GRULayer) NumOutputs() int {
+	if layer.OutputSequence && !layer.ConstantLengthInput && layer.OutputChunks == 0 {
+		return -1
+	} else if layer.OutputSequence && !layer.ConstantLengthInput {
+		return layer.Outputs * layer.OutputChunks
+	} else if layer.OutputSequence {
+		return layer.numTotalOutputs
+	}
+	return layer.Outputs
+}
+
+func (layer *GRULayer) NumParameters() int {
+	parameters := countParameters(layer.initialHiddenState)
+	for _, gate := range layer.gates() {
+		parameters += gate.NumParameters()
+	}
+	return parameters
+}
+
+func (layer *GRULayer) ChunkSizes() (int, int) {
+	return layer.InputSize, layer.Outputs
+}
+
+func (layer *GRULayer) ToBytes() []byte {
+	updateBytes := layer.updateGate.ToBytes()
+	resetBytes := layer.resetGate.ToBytes()
+	candidateBytes := layer.candidateGate.ToBytes()
+
+	saveBytes := save.ConstantsToBytes(layer.Outputs, layer.InputSize, utils.BoolToInt(layer.OutputSequence), utils.BoolToInt(layer.ConstantLengthInput), layer.OutputChunks, layer.numTotalOutputs, len(updateBytes))
+	saveBytes = append(saveBytes, updateBytes...)
+	saveBytes = append(saveBytes, resetBytes...)
+	saveBytes = append(saveBytes, candidateBytes...)
+
+	return append(saveBytes, save.ToBytes(utils.GetSlice(layer.initialHiddenState))...)
+}
+
+func (layer *GRULayer) FromBytes(bytes []byte) {
+	constInts, bytes := save.ConstantsFromBytes(bytes[:28]), bytes[28:]
+	layer.Outputs, layer.InputSize, layer.OutputSequence, layer.ConstantLengthInput, layer.OutputChunks = constInts[0], constInts[1], constInts[2] != 0, constInts[3] != 0, constInts[4]
+	layer.numTotalOutputs, layer.numConcat = constInts[5], constInts[0]+constInts[1]
+	gateSliceLength := constInts[6]
+
+	layer.updateGate.FromBytes(bytes[:gateSliceLength])
+	layer.resetGate.FromBytes(bytes[gateSliceLength : gateSliceLength*2])
+	layer.candidateGate.FromBytes(bytes[gateSliceLength*2 : gateSliceLength*3])
+
+	layer.initialHiddenState = utils.FromSlice(save.FromBytes(bytes[gateSliceLength*3:]))
+}
+
+func (layer *GRULayer) PrettyPrint() string {
+	ret := fmt.Sprintf("GRU Layer\n%d Inputs -> %d Outputs\n\n", layer.InputSize, layer.Outputs)
+	ret += "\n\nUpdate Gate:\n" + layer.updateGate.PrettyPrint()
+	ret += "\n\nReset Gate:\n" + layer.resetGate.PrettyPrint()
+	ret += "\n\nCandidate Gate:\n" + layer.candidateGate.PrettyPrint() + "\n\n\n"
+
+	ret += "\n\nInitial Hidden State:\n" + utils.JSify(layer.initialHiddenState)
+	return ret
+}
+
+/*
+The shift type for GRU Layers.
+*/
+type GRUShift struct {
+	updateShift    ShiftType
+	resetShift     ShiftType
+	candidateShift ShiftType
+
+	hiddenStateShift *mat.Dense
+}
+
+func (g *GRUShift) Apply(layer Layer, scale float64) {
+	gruLayer := layer.(*GRULayer)
+	if gruLayer.DecoupledDecay {
+		for _, gate := range gruLayer.gates() {
+			decayWeights(gate.weights, gruLayer.L1, gruLayer.L2, scale)
+		}
+	}
+	g.updateShift.Apply(&gruLayer.updateGate, scale)
+	g.resetShift.Apply(&gruLayer.resetGate, scale)
+	g.candidateShift.Apply(&gruLayer.candidateGate, scale)
+
+	g.hiddenStateShift.Scale(scale, g.hiddenStateShift)
+	gruLayer.initialHiddenState.Add(gruLayer.initialHiddenState, g.hiddenStateShift)
+}
+
+func (g *GRUShift) Combine(g2 ShiftType) ShiftType {
+	gru2 := g2.(*GRUShift)
+	g.updateShift = g.updateShift.Combine(gru2.updateShift)
+	g.resetShift = g.resetShift.Combine(gru2.resetShift)
+	g.candidateShift = g.candidateShift.Combine(gru2.candidateShift)
+
+	g.hiddenStateShift.Add(g.hiddenStateShift, gru2.hiddenStateShift)
+
+	return g
+}
+
+func (g *GRUShift) Optimize(opt optimizers.Optimizer, index int) {
+	g.updateShift.Optimize(opt, index)
+	g.resetShift.Optimize(opt, index+2)
+	g.candidateShift.Optimize(opt, index+4)
+
+	g.hiddenStateShift = opt.Rescale(g.hiddenStateShift, index+6)
+}
+
+func (g *GRUShift) NumMatrices() int {
+	return 7
+}
+
+func (g *GRUShift) Scale(f float64) {
+	g.updateShift.Scale(f)
+	g.resetShift.Scale(f)
+	g.candidateShift.Scale(f)
+
+	g.hiddenStateShift.Scale(f, g.hiddenStateShift)
+}
+
+func (g *GRUShift) SquaredNorm() float64 {
+	return g.updateShift.SquaredNorm() + g.resetShift.SquaredNorm() + g.candidateShift.SquaredNorm() + utils.SquaredNorm(g.hiddenStateShift)
+}
+
+func (g *GRUShift) Clip(limit float64) {
+	g.updateShift.Clip(limit)
+	g.resetShift.Clip(limit)
+	g.candidateShift.Clip(limit)
+
+	utils.ClipValues(g.hiddenStateShift, limit)
+}
@@ -2,6 +2,7 @@ package layers
 
 import (
 	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
 	"gonum.org/v1/gonum/mat"
 )
 
@@ -13,6 +14,9 @@ Initialize (numInputs int): Tells the layer how many inputs to expect, and sets
 Pass (*mat.Dense) (*mat.Dense, CacheType): Passes the input through the layer to get an output, and cache necessary information to do backprop.
 
 Back (cache CacheType, forwardGradients *mat.Dense) (shift ShiftType, backwardsGradients *mat.Dense): Takes the partial derivatives from the layers in front, calculates the gradient for itself, and passes it back to the last layer.
+
+Inputs are passed in batches, with each datapoint being one column of the input matrix, so a single
+datapoint is just a batch with one column. The shift returned by Back is summed across the whole batch.
 */
 type Layer interface {
 	Initialize(int)
@@ -30,6 +34,101 @@ type Shape struct {
 	Cols int
 }
 
+/*
+Layers whose outputs are a stack of 2D channels (like Conv2DLayer) implement SpatialLayer, so that
+the layers after them which need to know the shape of each channel (like MaxPool2DLayer) can be
+told automatically instead of having to be told by hand.
+*/
+type SpatialLayer interface {
+	OutputShape() Shape
+}
+
+type shapeReceiver interface {
+	setInputShape(Shape)
+}
+
+// Layers that are built out of other layers, like a ResidualLayer.
+type containerLayer interface {
+	sublayers() []Layer
+}
+
+/*
+Initializes each layer in the stack with the outputs of the one before it, and returns how many
+outputs the final layer has. Along the way, the channel shape from the last SpatialLayer is handed
+forward to any layer that wants it, until a layer changes how many values are being passed along.
+*/
+func InitializeStack(stack []Layer, numInputs int) int {
+	lastOutput, _ := initializeStack(stack, numInputs, Shape{})
+	return lastOutput
+}
+
+// Does the work of InitializeStack starting from the given channel shape, and also returns the shape coming out the end.
+func initializeStack(stack []Layer, numInputs int, inputShape Shape) (int, Shape) {
+	lastOutput, lastShape := numInputs, inputShape
+	for _, layer := range stack {
+		if receiver, ok := layer.(shapeReceiver); ok && lastShape.Rows > 0 {
+			receiver.setInputShape(lastShape)
+		}
+
+		layer.Initialize(lastOutput)
+
+		if spatial, ok := layer.(SpatialLayer); ok {
+			lastShape = spatial.OutputShape()
+		} else if layer.NumOutputs() != lastOutput {
+			lastShape = Shape{}
+		}
+		lastOutput = layer.NumOutputs()
+	}
+	return lastOutput, lastShape
+}
+
+/*
+Layers that act differently while training than they do otherwise (like DropoutLayer) implement
+TrainingLayer, and are told which mode to be in by the network. They should always start out as
+if they aren't training, so that evaluating a network is deterministic unless told otherwise.
+*/
+type TrainingLayer interface {
+	SetTraining(bool)
+}
+
+// Puts every layer in the stack that cares into (or out of) training mode.
+func SetTraining(stack []Layer, training bool) {
+	for _, layer := range stack {
+		if trainingLayer, ok := layer.(TrainingLayer); ok {
+			trainingLayer.SetTraining(training)
+		}
+	}
+}
+
+/*
+Layers that have values to learn implement ParameterizedLayer, which counts how many there are (so the
+size of a network can be summed up), and any layer without it doesn't learn anything.
+*/
+type ParameterizedLayer interface {
+	NumParameters() int
+}
+
+// Counts the learned values of every layer in the stack.
+func NumParameters(stack []Layer) int {
+	parameters := 0
+	for _, layer := range stack {
+		if parameterized, ok := layer.(ParameterizedLayer); ok {
+			parameters += parameterized.NumParameters()
+		}
+	}
+	return parameters
+}
+
+// Counts the values in all of the matrices.
+func countParameters(matrices ...*mat.Dense) int {
+	parameters := 0
+	for _, matrix := range matrices {
+		r, c := matrix.Dims()
+		parameters += r * c
+	}
+	return parameters
+}
+
 /*
 This is an interface for allowing layers to designate
 their own types of caches. For example, on Tanh layers,
@@ -45,8 +144,17 @@ type InputCache struct {
 type OutputCache struct {
 	Output *mat.Dense
 }
+type LayerNormCache struct {
+	Normed     *mat.Dense
+	InvStddevs *mat.Dense
+}
+type DropoutCache struct {
+	Mask *mat.Dense
+}
 type BatchNormCache struct {
-	Normed *mat.Dense
+	Normed          *mat.Dense
+	InvStddevs      *mat.Dense
+	BatchStatistics bool
 }
 
 type LSTMCache struct {
@@ -59,11 +167,58 @@ type LSTMCache struct {
 	OutputOutputs    []*mat.Dense
 }
 
+type GRUCache struct {
+	Inputs           []*mat.Dense
+	ResetInputs      []*mat.Dense
+	HiddenStates     []*mat.Dense
+	UpdateOutputs    []*mat.Dense
+	ResetOutputs     []*mat.Dense
+	CandidateOutputs []*mat.Dense
+}
+
+type AttentionCache struct {
+	Tokens     *mat.Dense
+	Queries    *mat.Dense
+	Keys       *mat.Dense
+	Values     *mat.Dense
+	Attentions []*mat.Dense
+	Combined   *mat.Dense
+}
+
+type TransformerCache struct {
+	AttentionCache       CacheType
+	AttentionNormCache   CacheType
+	FeedForwardNormCache CacheType
+	Tokens               *mat.Dense
+	Hidden               *mat.Dense
+	Activated            *mat.Dense
+}
+
+type BidirectionalCache struct {
+	ForwardCache  CacheType
+	BackwardCache CacheType
+}
+
+type ResidualCache struct {
+	LayerCaches     []CacheType
+	ProjectionCache CacheType
+}
+
+type ParallelCache struct {
+	BranchCaches [][]CacheType
+	BranchRows   []int
+}
+
 /*
 This is an interface for carrying all the different
 gradient steps that will be applied after backprop.
 The default NilShift is defined here, but most layer
 specific shift types are defined in their own files.
+
+SquaredNorm gets the sum of the squares of every value
+in the shift, so that the norm across many shifts can
+be found, and Clip clamps every value in place to be
+within plus or minus the given limit.
 */
 type ShiftType interface {
 	Apply(Layer, float64)
@@ -72,6 +227,8 @@ type ShiftType interface {
 
 	NumMatrices() int
 	Scale(float64)
+	SquaredNorm() float64
+	Clip(float64)
 }
 
 type NilShift struct{}
@@ -80,8 +237,10 @@ func (n *NilShift) Apply(_ Layer, _ float64)               {}
 func (n *NilShift) Combine(other ShiftType) ShiftType      { return other }
 func (n *NilShift) Optimize(_ optimizers.Optimizer, _ int) {}
 
-func (n *NilShift) NumMatrices() int { return 0 }
-func (n *NilShift) Scale(f float64)  {}
+func (n *NilShift) NumMatrices() int     { return 0 }
+func (n *NilShift) Scale(f float64)      {}
+func (n *NilShift) SquaredNorm() float64 { return 0 }
+func (n *NilShift) Clip(_ float64)       {}
 
 /*
 This allows for mapping between layer types and ints
@@ -113,6 +272,44 @@ func IndexToLayer(index int) Layer {
 		return &LanhLayer{}
 	case 11:
 		return &VariableLinearLayer{}
+	case 12:
+		return &DropoutLayer{}
+	case 13:
+		return &SpatialDropoutLayer{}
+	case 14:
+		return &LayerNormLayer{}
+	case 15:
+		return &GRULayer{}
+	case 16:
+		return &BidirectionalLayer{}
+	case 17:
+		return &MultiHeadAttentionLayer{}
+	case 18:
+		return &TransformerEncoderLayer{}
+	case 19:
+		return &SinusoidalEncodingLayer{}
+	case 20:
+		return &LearnedEncodingLayer{}
+	case 21:
+		return &EmbeddingLayer{}
+	case 22:
+		return &AvgPool2DLayer{}
+	case 23:
+		return &GlobalAvgPoolLayer{}
+	case 24:
+		return &GlobalMaxPoolLayer{}
+	case 25:
+		return &ConvTranspose2DLayer{}
+	case 26:
+		return &Upsample2DLayer{}
+	case 27:
+		return &Conv1DLayer{}
+	case 28:
+		return &MaxPool1DLayer{}
+	case 29:
+		return &ResidualLayer{}
+	case 30:
+		return &ParallelLayer{}
 	default:
 		return nil
 	}
@@ -144,7 +341,96 @@ func LayerToIndex(layer Layer) int {
 		return 10
 	case *VariableLinearLayer:
 		return 11
+	case *DropoutLayer:
+		return 12
+	case *SpatialDropoutLayer:
+		return 13
+	case *LayerNormLayer:
+		return 14
+	case *GRULayer:
+		return 15
+	case *BidirectionalLayer:
+		return 16
+	case *MultiHeadAttentionLayer:
+		return 17
+	case *TransformerEncoderLayer:
+		return 18
+	case *SinusoidalEncodingLayer:
+		return 19
+	case *LearnedEncodingLayer:
+		return 20
+	case *EmbeddingLayer:
+		return 21
+	case *AvgPool2DLayer:
+		return 22
+	case *GlobalAvgPoolLayer:
+		return 23
+	case *GlobalMaxPoolLayer:
+		return 24
+	case *ConvTranspose2DLayer:
+		return 25
+	case *Upsample2DLayer:
+		return 26
+	case *Conv1DLayer:
+		return 27
+	case *MaxPool1DLayer:
+		return 28
+	case *ResidualLayer:
+		return 29
+	case *ParallelLayer:
+		return 30
 	default:
 		return -1
 	}
 }
+
+/*
+Layers that are built out of other layers save each of them one after another,
+with the length of each one's bytes written in front so they can be split back up.
+*/
+func sublayersToBytes(sublayers ...Layer) []byte {
+	bytes := make([]byte, 0)
+	for _, sublayer := range sublayers {
+		sublayerBytes := sublayer.ToBytes()
+		bytes = append(bytes, save.ConstantsToBytes(len(sublayerBytes))...)
+		bytes = append(bytes, sublayerBytes...)
+	}
+	return bytes
+}
+
+// Loads each of the sublayers from bytes written by sublayersToBytes, and returns whatever bytes are left over.
+func sublayersFromBytes(bytes []byte, sublayers ...Layer) []byte {
+	for _, sublayer := range sublayers {
+		length := save.ConstantsFromBytes(bytes[:4])[0]
+		sublayer.FromBytes(bytes[4 : 4+length])
+		bytes = bytes[4+length:]
+	}
+	return bytes
+}
+
+/*
+Layers that hold whole stacks of other layers save them the same way a network does; the number of
+layers comes first, and then each one's index and the length of its bytes are written in front of it.
+*/
+func stackToBytes(stack []Layer) []byte {
+	bytes := save.ConstantsToBytes(len(stack))
+	for _, layer := range stack {
+		layerBytes := layer.ToBytes()
+		bytes = append(bytes, save.ConstantsToBytes(LayerToIndex(layer), len(layerBytes))...)
+		bytes = append(bytes, layerBytes...)
+	}
+	return bytes
+}
+
+// Rebuilds a stack of layers from bytes written by stackToBytes, and returns whatever bytes are left over.
+func stackFromBytes(bytes []byte) ([]Layer, []byte) {
+	stack := make([]Layer, save.ConstantsFromBytes(bytes[:4])[0])
+	bytes = bytes[4:]
+	for i := range stack {
+		layerData := save.ConstantsFromBytes(bytes[:8])
+		stack[i] = IndexToLayer(layerData[0])
+		stack[i].FromBytes(bytes[8 : 8+layerData[1]])
+		bytes = bytes[8+layerData[1]:]
+	}
+	return stack, bytes
+}
@@ -0,0 +1,192 @@
+package layers
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Layer normalization; each datapoint is normalized by its own mean and variance, so unlike batch
+normalization it doesn't matter what else is in the batch. If InputSize is set, the input is treated
+as a sequence of chunks of that size (like VariableLinearLayer does), and each chunk is normalized
+on its own, sharing the same learned gain and bias.
+*/
+type LayerNormLayer struct {
+	InputSize int
+	Epsilon   float64
+
+	gain *mat.Dense
+	bias *mat.Dense
+
+	n_inputs int
+}
+
+func (layer *LayerNormLayer) Initialize(n_inputs int) {
+	layer.n_inputs = n_inputs
+	if layer.Epsilon == 0 {
+		layer.Epsilon = 1e-5
+	}
+	if layer.InputSize == 0 {
+		if n_inputs <= 0 {
+			panic("A LayerNormLayer after a variable length output needs to be told its InputSize!")
+		}
+		layer.InputSize = n_inputs
+	}
+	if n_inputs > 0 && n_inputs%layer.InputSize != 0 {
+		panic(fmt.Sprintf("%d inputs can't be split into chunks of %d for a LayerNormLayer!", n_inputs, layer.InputSize))
+	}
+
+	if layer.gain != nil {
+		return
+	}
+	layer.gain, layer.bias = utils.FromSlice(utils.Duplicate(1.0, layer.InputSize)), mat.NewDense(layer.InputSize, 1, nil)
+}
+
+func (layer *LayerNormLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	rows, batchSize := input.Dims()
+	numChunks := rows / layer.InputSize
+	gain, bias := utils.GetSlice(layer.gain), utils.GetSlice(layer.bias)
+
+	normed, output, invStddevs := mat.NewDense(rows, batchSize, nil), mat.NewDense(rows, batchSize, nil), mat.NewDense(numChunks, batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		column := mat.Col(nil, b, input)
+		normedColumn, outputColumn := make([]float64, rows), make([]float64, rows)
+		for k := 0; k < numChunks; k++ {
+			chunk := column[k*layer.InputSize : (k+1)*layer.InputSize]
+			mean, variance := utils.Sum(chunk)/float64(layer.InputSize), 0.0
+			for _, v := range chunk {
+				variance += (v - mean) * (v - mean)
+			}
+			invStddev := 1 / math.Sqrt(variance/float64(layer.InputSize)+layer.Epsilon)
+			invStddevs.Set(k, b, invStddev)
+
+			for i, v := range chunk {
+				normedColumn[k*layer.InputSize+i] = (v - mean) * invStddev
+				outputColumn[k*layer.InputSize+i] = normedColumn[k*layer.InputSize+i]*gain[i] + bias[i]
+			}
+		}
+		normed.SetCol(b, normedColumn)
+		output.SetCol(b, outputColumn)
+	}
+
+	return output, &LayerNormCache{Normed: normed, InvStddevs: invStddevs}
+}
+
+func (layer *LayerNormLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	normed, invStddevs := cache.(*LayerNormCache).Normed, cache.(*LayerNormCache).InvStddevs
+	rows, batchSize := forwardGradients.Dims()
+	numChunks, n := rows/layer.InputSize, float64(layer.InputSize)
+	gain := utils.GetSlice(layer.gain)
+
+	gainShift, biasShift := make([]float64, layer.InputSize), make([]float64, layer.InputSize)
+	backwardGradients := mat.NewDense(rows, batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		gradientColumn, normedColumn := mat.Col(nil, b, forwardGradients), mat.Col(nil, b, normed)
+		backwardColumn := make([]float64, rows)
+		for k := 0; k < numChunks; k++ {
+			offset := k * layer.InputSize
+
+			// Get the gradient with respect to the normalized values, along with the shifts for the gain and bias
+			normedGradients := make([]float64, layer.InputSize)
+			gradientSum, weightedSum := 0.0, 0.0
+			for i := range normedGradients {
+				gradient, x := gradientColumn[offset+i], normedColumn[offset+i]
+				gainShift[i] += gradient * x
+				biasShift[i] += gradient
+
+				normedGradients[i] = gradient * gain[i]
+				gradientSum += normedGradients[i]
+				weightedSum += normedGradients[i] * x
+			}
+
+			// Then pass it back through the normalization, which depends on every value in the chunk
+			invStddev := invStddevs.At(k, b)
+			for i, g := range normedGradients {
+				backwardColumn[offset+i] = invStddev / n * (n*g - gradientSum - normedColumn[offset+i]*weightedSum)
+			}
+		}
+		backwardGradients.SetCol(b, backwardColumn)
+	}
+
+	return &LayerNormShift{gainShift: utils.FromSlice(gainShift), biasShift: utils.FromSlice(biasShift)}, backwardGradients
+}
+
+func (layer *LayerNormLayer) NumOutputs() int {
+	return layer.n_inputs
+}
+
+func (layer *LayerNormLayer) NumParameters() int {
+	return countParameters(layer.gain, layer.bias)
+}
+
+func (layer *LayerNormLayer) ToBytes() []byte {
+	bytes := save.ConstantsToBytes(layer.InputSize)
+	bytes = append(bytes, save.ToBytes([]float64{layer.Epsilon})...)
+	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.gain))...)
+	bytes = append(bytes, save.ToBytes(utils.GetSlice(layer.bias))...)
+	return bytes
+}
+
+func (layer *LayerNormLayer) FromBytes(bytes []byte) {
+	layer.InputSize = save.ConstantsFromBytes(bytes[:4])[0]
+	values := save.FromBytes(bytes[4:])
+
+	layer.Epsilon, values = values[0], values[1:]
+	layer.gain, layer.bias = utils.FromSlice(values[:layer.InputSize]), utils.FromSlice(values[layer.InputSize:])
+}
+
+func (layer *LayerNormLayer) PrettyPrint() string {
+	return fmt.Sprintf("LayerNorm Layer\nGain: %.4f\nBias: %.4f\n", utils.GetSlice(layer.gain), utils.GetSlice(layer.bias))
+}
+
+/*
+ShiftType used by LayerNormLayers
+*/
+type LayerNormShift struct {
+	gainShift *mat.Dense
+	biasShift *mat.Dense
+}
+
+func (l *LayerNormShift) Apply(rawLayer Layer, scale float64) {
+	layer := rawLayer.(*LayerNormLayer)
+
+	l.gainShift.Scale(scale, l.gainShift)
+	layer.gain.Add(layer.gain, l.gainShift)
+
+	l.biasShift.Scale(scale, l.biasShift)
+	layer.bias.Add(layer.bias, l.biasShift)
+}
+
+func (l *LayerNormShift) Combine(l2 ShiftType) ShiftType {
+	l.gainShift.Add(l.gainShift, l2.(*LayerNormShift).gainShift)
+	l.biasShift.Add(l.biasShift, l2.(*LayerNormShift).biasShift)
+	return l
+}
+
+func (l *LayerNormShift) Optimize(opt optimizers.Optimizer, index int) {
+	l.gainShift, l.biasShift = opt.Rescale(l.gainShift, index), opt.Rescale(l.biasShift, index+1)
+}
+
+func (l *LayerNormShift) NumMatrices() int {
+	return 2
+}
+
+func (l *LayerNormShift) Scale(f float64) {
+	l.gainShift.Scale(f, l.gainShift)
+	l.biasShift.Scale(f, l.biasShift)
+}
+
+func (l *LayerNormShift) SquaredNorm() float64 {
+	return utils.SquaredNorm(l.gainShift) + utils.SquaredNorm(l.biasShift)
+}
+
+func (l *LayerNormShift) Clip(limit float64) {
+	utils.ClipValues(l.gainShift, limit)
+	utils.ClipValues(l.biasShift, limit)
+}
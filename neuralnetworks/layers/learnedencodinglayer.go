@@ -0,0 +1,128 @@
+package layers
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Adds a learned encoding for each position onto a sequence of tokens InputSize long, so that the layers after it
+can tell where in the sequence each token is. There is one encoding for each of the first MaxLength positions,
+which defaults to however many tokens are coming in, and longer sequences can't be passed through.
+*/
+type LearnedEncodingLayer struct {
+	InputSize int
+	MaxLength int
+
+	encodings *mat.Dense
+	n_inputs  int
+}
+
+func (layer *LearnedEncodingLayer) Initialize(n_inputs int) {
+	layer.n_inputs = n_inputs
+	if layer.InputSize == 0 {
+		panic("You must specify how large each token going into a LearnedEncodingLayer is!")
+	}
+	if layer.MaxLength == 0 {
+		if n_inputs <= 0 {
+			panic("A LearnedEncodingLayer after a variable length output needs to be told its MaxLength!")
+		}
+		layer.MaxLength = n_inputs / layer.InputSize
+	}
+
+	if layer.encodings != nil {
+		return
+	}
+
+	// Start the encodings small, so they don't drown out the tokens they're being added to
+	initialEncodings := make([]float64, layer.InputSize*layer.MaxLength)
+	for i := range initialEncodings {
+		initialEncodings[i] = rand.NormFloat64() * 0.02
+	}
+	layer.encodings = mat.NewDense(layer.InputSize*layer.MaxLength, 1, initialEncodings)
+}
+
+func (layer *LearnedEncodingLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	rows, _ := input.Dims()
+	if rows > layer.InputSize*layer.MaxLength {
+		panic(fmt.Sprintf("A LearnedEncodingLayer with a MaxLength of %d was passed %d tokens!", layer.MaxLength, rows/layer.InputSize))
+	}
+
+	output := mat.DenseCopyOf(input)
+	utils.AddToColumns(output, layer.encodings.Slice(0, rows, 0, 1).(*mat.Dense))
+	return output, nil
+}
+
+func (layer *LearnedEncodingLayer) Back(_ CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	rows, _ := forwardGradients.Dims()
+	shift := mat.NewDense(layer.InputSize*layer.MaxLength, 1, nil)
+	shift.Slice(0, rows, 0, 1).(*mat.Dense).Copy(utils.SumColumns(forwardGradients))
+	return &EncodingShift{shift: shift}, forwardGradients
+}
+
+func (layer *LearnedEncodingLayer) NumOutputs() int {
+	return layer.n_inputs
+}
+
+func (layer *LearnedEncodingLayer) NumParameters() int {
+	return countParameters(layer.encodings)
+}
+
+func (layer *LearnedEncodingLayer) ToBytes() []byte {
+	saveBytes := save.ConstantsToBytes(layer.InputSize, layer.MaxLength)
+	return append(saveBytes, save.ToBytes(utils.GetSlice(layer.encodings))...)
+}
+
+func (layer *LearnedEncodingLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes[:8])
+	layer.InputSize, layer.MaxLength = constInts[0], constInts[1]
+	layer.encodings = utils.FromSlice(save.FromBytes(bytes[8:]))
+}
+
+func (layer *LearnedEncodingLayer) PrettyPrint() string {
+	return fmt.Sprintf("Learned Encoding Layer (%d Input Size, %d Max Length)\nEncodings: %.4f\n", layer.InputSize, layer.MaxLength, utils.GetSlice(layer.encodings))
+}
+
+/*
+ShiftType used by LearnedEncodingLayers
+*/
+type EncodingShift struct {
+	shift *mat.Dense
+}
+
+func (e *EncodingShift) Apply(layer Layer, scale float64) {
+	encodings := layer.(*LearnedEncodingLayer).encodings
+	e.shift.Scale(scale, e.shift)
+	encodings.Add(encodings, e.shift)
+}
+
+func (e *EncodingShift) Combine(e2 ShiftType) ShiftType {
+	e.shift.Add(e.shift, e2.(*EncodingShift).shift)
+	return e
+}
+
+func (e *EncodingShift) Optimize(opt optimizers.Optimizer, index int) {
+	e.shift = opt.Rescale(e.shift, index)
+}
+
+func (e *EncodingShift) NumMatrices() int {
+	return 1
+}
+
+func (e *EncodingShift) Scale(f float64) {
+	e.shift.Scale(f, e.shift)
+}
+
+func (e *EncodingShift) SquaredNorm() float64 {
+	return utils.SquaredNorm(e.shift)
+}
+
+func (e *EncodingShift) Clip(limit float64) {
+	utils.ClipValues(e.shift, limit)
+}
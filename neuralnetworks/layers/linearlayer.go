@@ -18,6 +18,10 @@ type LinearLayer struct {
 	Outputs int
 	NoBias  bool
 
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
 	weights  *mat.Dense
 	biases   *mat.Dense
 	n_inputs int
@@ -53,12 +57,13 @@ func (layer *LinearLayer) Initialize(numInputs int) {
 
 func (layer *LinearLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
 	// Multiply by weights
-	output := mat.NewDense(layer.Outputs, 1, nil)
+	_, batchSize := input.Dims()
+	output := mat.NewDense(layer.Outputs, batchSize, nil)
 	output.Mul(layer.weights, input)
 
 	// Add biases
 	if !layer.NoBias {
-		output.Add(output, layer.biases)
+		utils.AddToColumns(output, layer.biases)
 	}
 
 	return output, &InputCache{Input: input}
@@ -68,21 +73,33 @@ func (layer *LinearLayer) Back(cache CacheType, forwardGradients *mat.Dense) (Sh
 	inputs := cache.(*InputCache).Input
 
 	inputSize, _ := inputs.Dims()
-	gradSize, _ := forwardGradients.Dims()
+	gradSize, batchSize := forwardGradients.Dims()
 
 	shift := mat.NewDense(gradSize, inputSize, nil)
 	shift.Mul(forwardGradients, inputs.T())
 
-	newGradient := mat.NewDense(inputSize, 1, nil)
+	newGradient := mat.NewDense(inputSize, batchSize, nil)
 	newGradient.Mul(layer.weights.T(), forwardGradients)
 
-	return &WeightShift{weightShift: shift, biasShift: forwardGradients}, newGradient
+	if !layer.DecoupledDecay {
+		addPenaltyGradient(shift, layer.weights, layer.L1, layer.L2, float64(batchSize))
+	}
+
+	return &WeightShift{weightShift: shift, biasShift: utils.SumColumns(forwardGradients)}, newGradient
+}
+
+func (layer *LinearLayer) Penalty() float64 {
+	return weightPenalty(layer.weights, layer.L1, layer.L2)
 }
 
 func (layer *LinearLayer) NumOutputs() int {
 	return layer.Outputs
 }
 
+func (layer *LinearLayer) NumParameters() int {
+	return countParameters(layer.weights, layer.biases)
+}
+
 func (layer *LinearLayer) ToBytes() []byte {
 	weightSlice, biasSlice := save.ToBytes(utils.GetSlice(layer.weights)), save.ToBytes(utils.GetSlice(layer.biases))
 	saveBytes := save.ConstantsToBytes(layer.Outputs, len(weightSlice)/8)
@@ -120,9 +137,15 @@ func (w *WeightShift) Apply(layer Layer, scale float64) {
 
 	switch l := layer.(type) {
 	case *LinearLayer:
+		if l.DecoupledDecay {
+			decayWeights(l.weights, l.L1, l.L2, scale)
+		}
 		l.weights.Add(l.weights, w.weightShift)
 		l.biases.Add(l.biases, w.biasShift)
 	case *VariableLinearLayer:
+		if l.DecoupledDecay {
+			decayWeights(l.weights, l.L1, l.L2, scale)
+		}
 		l.weights.Add(l.weights, w.weightShift)
 		l.biases.Add(l.biases, w.biasShift)
 	}
@@ -147,3 +170,12 @@ func (w *WeightShift) Scale(f float64) {
 func (w *WeightShift) NumMatrices() int {
 	return 2
 }
+
+func (w *WeightShift) SquaredNorm() float64 {
+	return utils.SquaredNorm(w.weightShift) + utils.SquaredNorm(w.biasShift)
+}
+
+func (w *WeightShift) Clip(limit float64) {
+	utils.ClipValues(w.weightShift, limit)
+	utils.ClipValues(w.biasShift, limit)
+}
@@ -18,6 +18,11 @@ type LSTMLayer struct {
 	ConstantLengthInput bool
 	OutputChunks        int
 
+	// Weight penalties on all four gates, counted once per sequence rather than once per step.
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
 	numConcat       int
 	numTotalOutputs int
 
@@ -37,75 +42,84 @@ func (layer *LSTMLayer) Initialize(totalInputs int) {
 	if layer.InputSize == 0 {
 		panic("Set how large each input chuck being passed to your LSTM layer is!")
 	}
-	if layer.initialCellState != nil {
-		return
-	}
 
 	layer.numConcat = layer.InputSize + layer.Outputs
 	if layer.ConstantLengthInput {
 		layer.numTotalOutputs = totalInputs / layer.InputSize * layer.Outputs
 	}
 
-	layer.forgetGate = LinearLayer{Outputs: layer.Outputs}
-	layer.forgetGate.Initialize(layer.numConcat)
+	for _, gate := range layer.gates() {
+		gate.Outputs = layer.Outputs
+		gate.Initialize(layer.numConcat)
+	}
 
-	layer.inputGate = LinearLayer{Outputs: layer.Outputs}
-	layer.inputGate.Initialize(layer.numConcat)
+	if layer.initialCellState == nil {
+		layer.initialHiddenState, layer.initialCellState = mat.NewDense(layer.Outputs, 1, nil), mat.NewDense(layer.Outputs, 1, nil)
+	}
+}
 
-	layer.candidateGate = LinearLayer{Outputs: layer.Outputs}
-	layer.candidateGate.Initialize(layer.numConcat)
+func (layer *LSTMLayer) gates() []*LinearLayer {
+	return []*LinearLayer{&layer.forgetGate, &layer.inputGate, &layer.candidateGate, &layer.outputGate}
+}
+
+// Passes the input through the gate, then applies the activation to every output.
+func passThroughGate(gate *LinearLayer, input *mat.Dense, activation func(float64) float64) *mat.Dense {
+	output, _ := gate.Pass(input)
+	output.Apply(func(_ int, _ int, v float64) float64 {
+		return activation(v)
+	}, output)
+	return output
+}
 
-	layer.outputGate = LinearLayer{Outputs: layer.Outputs}
-	layer.outputGate.Initialize(layer.numConcat)
+// Stacks the given chunks on top of each other into one matrix.
+func stackChunks(chunks []*mat.Dense) *mat.Dense {
+	totalRows, batchSize := 0, 0
+	for _, chunk := range chunks {
+		chunkRows, chunkCols := chunk.Dims()
+		totalRows, batchSize = totalRows+chunkRows, chunkCols
+	}
 
-	layer.initialHiddenState, layer.initialCellState = mat.NewDense(layer.Outputs, 1, nil), mat.NewDense(layer.Outputs, 1, nil)
+	stacked, row := mat.NewDense(totalRows, batchSize, nil), 0
+	for _, chunk := range chunks {
+		chunkRows, _ := chunk.Dims()
+		stacked.Slice(row, row+chunkRows, 0, batchSize).(*mat.Dense).Copy(chunk)
+		row += chunkRows
+	}
+	return stacked
 }
 
 func (layer *LSTMLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
-	hiddenState, cellState := mat.NewDense(layer.Outputs, 1, nil), mat.NewDense(layer.Outputs, 1, nil)
-	hiddenState.Copy(layer.initialHiddenState)
-	hiddenState.Copy(layer.initialCellState)
-
-	inputSlice := utils.GetSlice(input)
+	inputRows, batchSize := input.Dims()
+	hiddenState, cellState := utils.RepeatColumn(layer.initialHiddenState, batchSize), utils.RepeatColumn(layer.initialCellState, batchSize)
 
-	hiddenStates := make([]float64, 0)
-	inputs, cellStates, forgetOutputs, inputOutputs, candidateOutputs, outputOutputs := make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0)
+	inputs, hiddenStates, cellStates, forgetOutputs, inputOutputs, candidateOutputs, outputOutputs := make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0), make([]*mat.Dense, 0)
 
-	for i := 0; i < len(inputSlice); i += layer.InputSize {
-		concatInput := utils.FromSlice(append(utils.GetSlice(hiddenState), inputSlice[i:i+layer.InputSize]...))
+	for i := 0; i < inputRows; i += layer.InputSize {
+		concatInput := stackChunks([]*mat.Dense{hiddenState, mat.DenseCopyOf(input.Slice(i, i+layer.InputSize, 0, batchSize))})
 		inputs = append(inputs, concatInput)
 
 		// Forget Gate
-		forgetOutput, _ := layer.forgetGate.Pass(concatInput)
-		forgetOutput.Apply(func(i int, j int, v float64) float64 {
-			return sigmoid(v)
-		}, forgetOutput)
-		cellState.MulElem(forgetOutput, cellState)
+		forgetOutput := passThroughGate(&layer.forgetGate, concatInput, sigmoid)
 		forgetOutputs = append(forgetOutputs, forgetOutput)
 
 		// Input and Candidate Gate
-		inputOutput, _ := layer.forgetGate.Pass(concatInput)
-		inputOutput.Apply(func(i int, j int, v float64) float64 {
-			return sigmoid(v)
-		}, inputOutput)
+		inputOutput := passThroughGate(&layer.inputGate, concatInput, sigmoid)
 		inputOutputs = append(inputOutputs, inputOutput)
 
-		candidateOutput, _ := layer.forgetGate.Pass(concatInput)
-		candidateOutput.Apply(func(i int, j int, v float64) float64 {
-			return math.Tanh(v)
-		}, candidateOutput)
+		candidateOutput := passThroughGate(&layer.candidateGate, concatInput, math.Tanh)
 		candidateOutputs = append(candidateOutputs, candidateOutput)
 
 		newMemories := utils.DenseLike(candidateOutput)
 		newMemories.MulElem(inputOutput, candidateOutput)
 
-		cellState.Add(newMemories, cellState)
+		nextCellState := utils.DenseLike(cellState)
+		nextCellState.MulElem(forgetOutput, cellState)
+		nextCellState.Add(nextCellState, newMemories)
+		cellState = nextCellState
+		cellStates = append(cellStates, cellState)
 
 		// Output Gate
-		outputOutput, _ := layer.forgetGate.Pass(concatInput)
-		outputOutput.Apply(func(i int, j int, v float64) float64 {
-			return sigmoid(v)
-		}, outputOutput)
+		outputOutput := passThroughGate(&layer.outputGate, concatInput, sigmoid)
 		outputOutputs = append(outputOutputs, outputOutput)
 
 		tanhCellState := utils.DenseLike(cellState)
@@ -113,13 +127,14 @@ func (layer *LSTMLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
 			return math.Tanh(v)
 		}, cellState)
 
+		hiddenState = utils.DenseLike(cellState)
 		hiddenState.MulElem(outputOutput, tanhCellState)
-		hiddenStates = append(hiddenStates, utils.GetSlice(hiddenState)...)
-		cellStates = append(cellStates, cellState)
+		hiddenStates = append(hiddenStates, hiddenState)
 	}
 
 	layerCache := &LSTMCache{
 		Inputs:           inputs,
+		HiddenStates:     hiddenStates,
 		CellStates:       cellStates,
 		ForgetOutputs:    forgetOutputs,
 		InputOutputs:     inputOutputs,
@@ -128,9 +143,9 @@ func (layer *LSTMLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
 	}
 
 	if layer.OutputSequence && layer.OutputChunks == 0 {
-		return utils.FromSlice(hiddenStates), layerCache
+		return stackChunks(hiddenStates), layerCache
 	} else if layer.OutputSequence {
-		return utils.FromSlice(hiddenStates[len(hiddenStates)-layer.OutputChunks*layer.Outputs:]), layerCache
+		return stackChunks(hiddenStates[len(hiddenStates)-layer.OutputChunks:]), layerCache
 	}
 	return hiddenState, layerCache
 }
@@ -142,25 +157,23 @@ func (layer *LSTMLayer) Back(cache CacheType, frontalPass *mat.Dense) (shift Shi
 	var forgetShift, inputShift, candidateShift, outputShift ShiftType
 	forgetShift, inputShift, candidateShift, outputShift = &NilShift{}, &NilShift{}, &NilShift{}, &NilShift{}
 
-	// If we output a sequence, we will have loss gradients for each individual input. However,
-	// if we didn't, then we will say we have zero loss for every hidden state except the last.
-	var forwardGradients []*mat.Dense
-	cutGradients := utils.Map(utils.Cut(utils.GetSlice(frontalPass), layer.Outputs), utils.FromSlice)
-	if layer.OutputSequence {
-		forwardGradients = cutGradients
-	} else {
-		forwardGradients = utils.Duplicate(mat.NewDense(layer.Outputs, 1, nil), len(inputs))
-		for i, gradient := range cutGradients {
-			forwardGradients[len(forwardGradients)-layer.OutputChunks+i] = gradient
-		}
+	// We only have loss gradients for the hidden states we actually output, which are always the last
+	// ones in the sequence. Every hidden state before those is said to have zero loss of its own.
+	frontalRows, batchSize := frontalPass.Dims()
+	numGradients := frontalRows / layer.Outputs
+	forwardGradients := make([]*mat.Dense, len(inputs))
+	for i := 0; i < numGradients; i++ {
+		forwardGradients[len(inputs)-numGradients+i] = mat.DenseCopyOf(frontalPass.Slice(i*layer.Outputs, (i+1)*layer.Outputs, 0, batchSize))
 	}
 
-	backwardGradients := make([]float64, 0)
+	backwardGradients := mat.NewDense(len(inputs)*layer.InputSize, batchSize, nil)
 
-	cellStateGradient, hiddenStateGradient := mat.NewDense(layer.Outputs, 1, nil), mat.NewDense(layer.Outputs, 1, nil)
-	for i := len(forwardGradients) - 1; i >= 0; i-- {
-		// Combine the loss gradient calculated for this current frame with the one passed back from the layer ahead.
-		hiddenStateGradient.Add(hiddenStateGradient, forwardGradients[i])
+	cellStateGradient, hiddenStateGradient := mat.NewDense(layer.Outputs, batchSize, nil), mat.NewDense(layer.Outputs, batchSize, nil)
+	for i := len(inputs) - 1; i >= 0; i-- {
+		// Combine the loss gradient calculated for this current frame with the one passed back from the frame ahead.
+		if forwardGradients[i] != nil {
+			hiddenStateGradient.Add(hiddenStateGradient, forwardGradients[i])
+		}
 
 		// Combine the hidden state gradient into the cell state's gradient
 		tanhCellState := utils.DenseLike(cellStates[i])
@@ -207,15 +220,15 @@ func (layer *LSTMLayer) Back(cache CacheType, frontalPass *mat.Dense) (shift Shi
 		candidateShift = candidateShift.Combine(localCandidateShift)
 
 		// Forget Gate Gradient Calculation
-		var initialCellState *mat.Dense
+		var lastCellState *mat.Dense
 		if i == 0 {
-			initialCellState = utils.DenseLike(cellStateGradient)
+			lastCellState = utils.RepeatColumn(layer.initialCellState, batchSize)
 		} else {
-			initialCellState = cellStates[i-1]
+			lastCellState = cellStates[i-1]
 		}
 
 		forgetGateGradient := utils.DenseLike(cellStateGradient)
-		forgetGateGradient.MulElem(initialCellState, cellStateGradient)
+		forgetGateGradient.MulElem(lastCellState, cellStateGradient)
 		forgetGateGradient.Apply(func(r, c int, v float64) float64 {
 			forgetVal := forgetOutputs[i].At(r, c)
 			return v * forgetVal * (1 - forgetVal)
@@ -230,8 +243,16 @@ func (layer *LSTMLayer) Back(cache CacheType, frontalPass *mat.Dense) (shift Shi
 		combinedPassback.Add(combinedPassback, candidatePassback)
 		combinedPassback.Add(combinedPassback, outputPassback)
 
-		hiddenStateGradient = utils.FromSlice(utils.GetSlice(combinedPassback)[:layer.Outputs])
-		backwardGradients = append(utils.GetSlice(combinedPassback)[layer.Outputs:], backwardGradients...)
+		hiddenStateGradient = mat.DenseCopyOf(combinedPassback.Slice(0, layer.Outputs, 0, batchSize))
+		backwardGradients.Slice(i*layer.InputSize, (i+1)*layer.InputSize, 0, batchSize).(*mat.Dense).Copy(combinedPassback.Slice(layer.Outputs, layer.numConcat, 0, batchSize))
+	}
+
+	if !layer.DecoupledDecay {
+		for i, shift := range []ShiftType{forgetShift, inputShift, candidateShift, outputShift} {
+			if weightShift, ok := shift.(*WeightShift); ok {
+				addPenaltyGradient(weightShift.weightShift, layer.gates()[i].weights, layer.L1, layer.L2, float64(batchSize))
+			}
+		}
 	}
 
 	return &LSTMShift{
@@ -239,9 +260,17 @@ func (layer *LSTMLayer) Back(cache CacheType, frontalPass *mat.Dense) (shift Shi
 		inputShift:       inputShift,
 		candidateShift:   candidateShift,
 		outputShift:      outputShift,
-		cellStateShift:   cellStateGradient,
-		hiddenStateShift: hiddenStateGradient,
-	}, utils.FromSlice(backwardGradients)
+		cellStateShift:   utils.SumColumns(cellStateGradient),
+		hiddenStateShift: utils.SumColumns(hiddenStateGradient),
+	}, backwardGradients
+}
+
+func (layer *LSTMLayer) Penalty() float64 {
+	penalty := 0.0
+	for _, gate := range layer.gates() {
+		penalty += weightPenalty(gate.weights, layer.L1, layer.L2)
+	}
+	return penalty
 }
 
 func (layer *LSTMLayer) NumOutputs() int {
@@ -255,6 +284,18 @@ func (layer *LSTMLayer) NumOutputs() int {
 	return layer.Outputs
 }
 
+func (layer *LSTMLayer) NumParameters() int {
+	parameters := countParameters(layer.initialHiddenState, layer.initialCellState)
+	for _, gate := range layer.gates() {
+		parameters += gate.NumParameters()
+	}
+	return parameters
+}
+
+func (layer *LSTMLayer) ChunkSizes() (int, int) {
+	return layer.InputSize, layer.Outputs
+}
+
 func (layer *LSTMLayer) ToBytes() []byte {
 	forgetBytes := layer.forgetGate.ToBytes()
 	inputBytes := layer.inputGate.ToBytes()
@@ -318,6 +359,11 @@ type LSTMShift struct {
 
 func (l *LSTMShift) Apply(layer Layer, scale float64) {
 	lstmLayer := layer.(*LSTMLayer)
+	if lstmLayer.DecoupledDecay {
+		for _, gate := range lstmLayer.gates() {
+			decayWeights(gate.weights, lstmLayer.L1, lstmLayer.L2, scale)
+		}
+	}
 	l.forgetShift.Apply(&lstmLayer.forgetGate, scale)
 	l.inputShift.Apply(&lstmLayer.inputGate, scale)
 	l.candidateShift.Apply(&lstmLayer.candidateGate, scale)
@@ -360,4 +406,22 @@ func (l *LSTMShift) Scale(f float64) {
 	l.inputShift.Scale(f)
 	l.candidateShift.Scale(f)
 	l.outputShift.Scale(f)
+
+	l.cellStateShift.Scale(f, l.cellStateShift)
+	l.hiddenStateShift.Scale(f, l.hiddenStateShift)
+}
+
+func (l *LSTMShift) SquaredNorm() float64 {
+	norm := l.forgetShift.SquaredNorm() + l.inputShift.SquaredNorm() + l.candidateShift.SquaredNorm() + l.outputShift.SquaredNorm()
+	return norm + utils.SquaredNorm(l.cellStateShift) + utils.SquaredNorm(l.hiddenStateShift)
+}
+
+func (l *LSTMShift) Clip(limit float64) {
+	l.forgetShift.Clip(limit)
+	l.inputShift.Clip(limit)
+	l.candidateShift.Clip(limit)
+	l.outputShift.Clip(limit)
+
+	utils.ClipValues(l.cellStateShift, limit)
+	utils.ClipValues(l.hiddenStateShift, limit)
 }
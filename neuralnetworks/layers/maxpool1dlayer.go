@@ -0,0 +1,131 @@
+package layers
+
+import (
+	"fmt"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Max pooling along a sequence laid out like the inputs of a Conv1DLayer, where each step is a chunk of InputSize
+values; each channel of an output step is the largest value that channel takes over PoolWidth steps in a row. The
+pool moves Stride steps at a time (PoolWidth by default, so the pools don't overlap), and Padding and PaddingWidth
+work like they do for a Conv1DLayer, so sequences that don't divide evenly can still be pooled (though a sequence
+shorter than a single pool, once padded, is rejected). The gradient of each output only goes back to the value that
+was picked (the first one, if there's a tie).
+*/
+type MaxPool1DLayer struct {
+	InputSize int
+	PoolWidth int
+
+	Stride       int
+	Padding      string
+	PaddingWidth int
+
+	ConstantLengthInput bool
+	inputLength         int
+}
+
+func (layer *MaxPool1DLayer) Initialize(numInputs int) {
+	if layer.InputSize == 0 {
+		panic("You must specify how large each step going into a MaxPool1DLayer is!")
+	}
+	if layer.PoolWidth == 0 {
+		panic("You must specify the PoolWidth of a MaxPool1DLayer!")
+	}
+
+	if layer.ConstantLengthInput {
+		layer.inputLength = numInputs
+	}
+	if layer.Stride == 0 {
+		layer.Stride = layer.PoolWidth
+	}
+	if layer.Padding == "" {
+		layer.Padding = ValidPadding
+	}
+}
+
+// Lines the pool up with a sequence of the given number of steps, treating it as a convolution over a single row.
+func (layer *MaxPool1DLayer) geometry(steps int) convGeometry {
+	return newSequenceGeometry("MaxPool1DLayer", steps, layer.PoolWidth, layer.Stride, 1, layer.Padding, layer.PaddingWidth)
+}
+
+// Finds which row of the input each output takes its value from, for every datapoint in the batch.
+func (layer *MaxPool1DLayer) maxRows(input *mat.Dense) [][]int {
+	inputRows, batchSize := input.Dims()
+	geometry := layer.geometry(inputRows / layer.InputSize)
+
+	maxRows := make([][]int, geometry.output.Cols*layer.InputSize)
+	for r := range maxRows {
+		maxRows[r] = make([]int, batchSize)
+		for b := range maxRows[r] {
+			maxRows[r][b] = -1
+		}
+	}
+
+	geometry.forEach(func(o, _, i int) {
+		for c := 0; c < layer.InputSize; c++ {
+			outputRow, inputRow := o*layer.InputSize+c, i*layer.InputSize+c
+			for b, maxRow := range maxRows[outputRow] {
+				if maxRow < 0 || input.At(inputRow, b) > input.At(maxRow, b) {
+					maxRows[outputRow][b] = inputRow
+				}
+			}
+		}
+	})
+	return maxRows
+}
+
+func (layer *MaxPool1DLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	_, batchSize := input.Dims()
+	maxRows := layer.maxRows(input)
+
+	output := mat.NewDense(len(maxRows), batchSize, nil)
+	for r, rows := range maxRows {
+		for b, i := range rows {
+			// Pools that only cover padding are left at zero
+			if i >= 0 {
+				output.Set(r, b, input.At(i, b))
+			}
+		}
+	}
+	return output, &InputCache{Input: input}
+}
+
+func (layer *MaxPool1DLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	input := cache.(*InputCache).Input
+
+	backwardGradients := utils.DenseLike(input)
+	for r, rows := range layer.maxRows(input) {
+		for b, i := range rows {
+			if i >= 0 {
+				backwardGradients.Set(i, b, backwardGradients.At(i, b)+forwardGradients.At(r, b))
+			}
+		}
+	}
+	return &NilShift{}, backwardGradients
+}
+
+func (layer *MaxPool1DLayer) NumOutputs() int {
+	if layer.ConstantLengthInput {
+		return layer.geometry(layer.inputLength/layer.InputSize).output.Cols * layer.InputSize
+	}
+	return -1
+}
+
+func (layer *MaxPool1DLayer) ToBytes() []byte {
+	return save.ConstantsToBytes(layer.InputSize, layer.PoolWidth, layer.Stride, paddingToIndex(layer.Padding), layer.PaddingWidth, utils.BoolToInt(layer.ConstantLengthInput))
+}
+
+func (layer *MaxPool1DLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes)
+	layer.InputSize, layer.PoolWidth, layer.Stride = constInts[0], constInts[1], constInts[2]
+	layer.Padding, layer.PaddingWidth, layer.ConstantLengthInput = indexToPadding(constInts[3]), constInts[4], constInts[5] != 0
+}
+
+func (layer *MaxPool1DLayer) PrettyPrint() string {
+	return fmt.Sprintf("MaxPool1D (%d steps of %d)\nStride %d, %s padding\n", layer.PoolWidth, layer.InputSize, layer.Stride, layer.Padding)
+}
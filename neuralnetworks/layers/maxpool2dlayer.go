@@ -9,8 +9,14 @@ import (
 	"gonum.org/v1/gonum/mat"
 )
 
+/*
+Max pooling over the channels output by a Conv2DLayer. The InputShape (the shape of each channel)
+is picked up automatically from a Conv2DLayer before it, and otherwise each datapoint is just
+treated as one tall column.
+*/
 type MaxPool2DLayer struct {
-	PoolShape Shape
+	PoolShape  Shape
+	InputShape Shape
 
 	n_inputs int
 }
@@ -21,7 +27,11 @@ func (layer *MaxPool2DLayer) Initialize(n_inputs int) {
 		panic(1)
 	}
 
-	if n_inputs%(layer.PoolShape.Rows*layer.PoolShape.Cols) != 0 {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = Shape{Rows: n_inputs, Cols: 1}
+	}
+
+	if n_inputs%(layer.PoolShape.Rows*layer.PoolShape.Cols) != 0 || layer.InputShape.Rows%layer.PoolShape.Rows != 0 || layer.InputShape.Cols%layer.PoolShape.Cols != 0 {
 		fmt.Printf("%d outputs from the last layer can't be pooled by an %dx%d pool!\n", n_inputs, layer.PoolShape.Rows, layer.PoolShape.Cols)
 		panic(1)
 	}
@@ -29,18 +39,39 @@ func (layer *MaxPool2DLayer) Initialize(n_inputs int) {
 	layer.n_inputs = n_inputs
 }
 
+func (layer *MaxPool2DLayer) setInputShape(shape Shape) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = shape
+	}
+}
+
+// Gets one datapoint from the batch in the form of its channels stacked on top of each other.
+func (layer *MaxPool2DLayer) getChannels(input *mat.Dense, b int) *mat.Dense {
+	return mat.NewDense(layer.n_inputs/layer.InputShape.Cols, layer.InputShape.Cols, mat.Col(nil, b, input))
+}
+
 func (layer *MaxPool2DLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
-	return utils.MaxPool(input, layer.PoolShape.Rows, layer.PoolShape.Cols), &InputCache{Input: input}
+	_, batchSize := input.Dims()
+	output := mat.NewDense(layer.NumOutputs(), batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		output.SetCol(b, utils.GetSlice(utils.MaxPool(layer.getChannels(input, b), layer.PoolShape.Rows, layer.PoolShape.Cols)))
+	}
+	return output, &InputCache{Input: input}
 }
 
 func (layer *MaxPool2DLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
 	inputs := cache.(*InputCache).Input
+	r, c := inputs.Dims()
+	returnMatrix := mat.NewDense(r, c, nil)
 
-	grownGradients := utils.UnMaxPool(forwardGradients, layer.PoolShape.Rows, layer.PoolShape.Cols)
-	gradientMap := utils.MaxPoolMap(inputs, layer.PoolShape.Rows, layer.PoolShape.Cols)
+	for b := 0; b < c; b++ {
+		pooledGradients := mat.NewDense(layer.n_inputs/layer.InputShape.Cols/layer.PoolShape.Rows, layer.InputShape.Cols/layer.PoolShape.Cols, mat.Col(nil, b, forwardGradients))
 
-	r, c := inputs.Dims()
-	returnMatrix := mat.NewDense(r, c, utils.FastDot(utils.GetSlice(grownGradients), utils.GetSlice(gradientMap)))
+		grownGradients := utils.UnMaxPool(pooledGradients, layer.PoolShape.Rows, layer.PoolShape.Cols)
+		gradientMap := utils.MaxPoolMap(layer.getChannels(inputs, b), layer.PoolShape.Rows, layer.PoolShape.Cols)
+
+		returnMatrix.SetCol(b, utils.FastDot(utils.GetSlice(grownGradients), utils.GetSlice(gradientMap)))
+	}
 
 	return &NilShift{}, returnMatrix
 }
@@ -49,14 +80,23 @@ func (layer *MaxPool2DLayer) NumOutputs() int {
 	return layer.n_inputs / layer.PoolShape.Rows / layer.PoolShape.Cols
 }
 
+func (layer *MaxPool2DLayer) OutputShape() Shape {
+	return Shape{Rows: layer.InputShape.Rows / layer.PoolShape.Rows, Cols: layer.InputShape.Cols / layer.PoolShape.Cols}
+}
+
 func (layer *MaxPool2DLayer) ToBytes() []byte {
-	saveBytes := save.ConstantsToBytes(layer.PoolShape.Rows, layer.PoolShape.Cols)
+	saveBytes := save.ConstantsToBytes(layer.PoolShape.Rows, layer.PoolShape.Cols, layer.InputShape.Rows, layer.InputShape.Cols)
 	return saveBytes
 }
 
 func (layer *MaxPool2DLayer) FromBytes(bytes []byte) {
 	constInts := save.ConstantsFromBytes(bytes)
 	layer.PoolShape = Shape{Rows: constInts[0], Cols: constInts[1]}
+
+	// Older saves didn't keep track of the input shape, in which case it'll be picked up on Initialize.
+	if len(constInts) >= 4 {
+		layer.InputShape = Shape{Rows: constInts[2], Cols: constInts[3]}
+	}
 }
 
 func (layer *MaxPool2DLayer) PrettyPrint() string {
@@ -0,0 +1,360 @@
+package layers
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Multi-head scaled dot-product self-attention. Just like VariableLinearLayer, the input is read as a sequence of
+tokens InputSize long, and there is one output token of OutputSize (InputSize by default) for every input token.
+
+Every token is projected into a query and key of KeySize and a value of ValueSize for each of the Heads (1 by
+default). Each head then mixes the values of every token together, weighted by the softmax of how well each query
+lines up with each key, and the heads' outputs are concatenated and projected back out to OutputSize. KeySize
+defaults to InputSize / Heads, and ValueSize to KeySize. If Causal is set, a token can only attend to itself and
+the tokens before it.
+*/
+type MultiHeadAttentionLayer struct {
+	InputSize  int
+	OutputSize int
+
+	Heads     int
+	KeySize   int
+	ValueSize int
+	Causal    bool
+
+	ConstantLengthInput bool
+	inputLength         int
+
+	// Weight penalties on all four projections.
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
+	queryProjection  LinearLayer
+	keyProjection    LinearLayer
+	valueProjection  LinearLayer
+	outputProjection LinearLayer
+}
+
+func (layer *MultiHeadAttentionLayer) Initialize(numInputs int) {
+	if layer.ConstantLengthInput {
+		layer.inputLength = numInputs
+	}
+
+	if layer.InputSize == 0 {
+		panic("You must specify how large each token going into a MultiHeadAttentionLayer is!")
+	}
+	if layer.OutputSize == 0 {
+		layer.OutputSize = layer.InputSize
+	}
+	if layer.Heads == 0 {
+		layer.Heads = 1
+	}
+	if layer.KeySize == 0 {
+		layer.KeySize = layer.InputSize / layer.Heads
+	}
+	if layer.KeySize == 0 {
+		panic("A MultiHeadAttentionLayer with more Heads than its InputSize needs to be told its KeySize!")
+	}
+	if layer.ValueSize == 0 {
+		layer.ValueSize = layer.KeySize
+	}
+
+	layer.queryProjection.Outputs, layer.keyProjection.Outputs = layer.Heads*layer.KeySize, layer.Heads*layer.KeySize
+	layer.valueProjection.Outputs, layer.outputProjection.Outputs = layer.Heads*layer.ValueSize, layer.OutputSize
+
+	layer.queryProjection.Initialize(layer.InputSize)
+	layer.keyProjection.Initialize(layer.InputSize)
+	layer.valueProjection.Initialize(layer.InputSize)
+	layer.outputProjection.Initialize(layer.Heads * layer.ValueSize)
+}
+
+func (layer *MultiHeadAttentionLayer) projections() []*LinearLayer {
+	return []*LinearLayer{&layer.queryProjection, &layer.keyProjection, &layer.valueProjection, &layer.outputProjection}
+}
+
+// Lays the tokens of every datapoint side by side, so that each token is its own column and a whole batch of
+// sequences can go through the same projection at once. The tokens of the first datapoint come first, and so on.
+func chunksToColumns(input *mat.Dense, chunkSize int) *mat.Dense {
+	rows, batchSize := input.Dims()
+	numChunks := rows / chunkSize
+	columns := mat.NewDense(chunkSize, numChunks*batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		for t := 0; t < numChunks; t++ {
+			columns.Slice(0, chunkSize, b*numChunks+t, b*numChunks+t+1).(*mat.Dense).Copy(input.Slice(t*chunkSize, (t+1)*chunkSize, b, b+1))
+		}
+	}
+	return columns
+}
+
+// The reverse of chunksToColumns, stacking the tokens of each datapoint back up into a single column.
+func columnsToChunks(columns *mat.Dense, batchSize int) *mat.Dense {
+	chunkSize, totalChunks := columns.Dims()
+	numChunks := totalChunks / batchSize
+	output := mat.NewDense(numChunks*chunkSize, batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		for t := 0; t < numChunks; t++ {
+			output.Slice(t*chunkSize, (t+1)*chunkSize, b, b+1).(*mat.Dense).Copy(columns.Slice(0, chunkSize, b*numChunks+t, b*numChunks+t+1))
+		}
+	}
+	return output
+}
+
+// Softmaxes each row of the scores in place, ignoring any scores that are masked out to negative infinity.
+func softmaxRows(scores *mat.Dense) {
+	rows, _ := scores.Dims()
+	for i := 0; i < rows; i++ {
+		row := scores.RawRowView(i)
+		max := utils.Reduce(row, math.Max)
+		sum := 0.0
+		for j, v := range row {
+			row[j] = math.Exp(v - max)
+			sum += row[j]
+		}
+		for j := range row {
+			row[j] /= sum
+		}
+	}
+}
+
+func (layer *MultiHeadAttentionLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	inputRows, batchSize := input.Dims()
+	numTokens := inputRows / layer.InputSize
+	scale := 1 / math.Sqrt(float64(layer.KeySize))
+
+	tokens := chunksToColumns(input, layer.InputSize)
+	queries, _ := layer.queryProjection.Pass(tokens)
+	keys, _ := layer.keyProjection.Pass(tokens)
+	values, _ := layer.valueProjection.Pass(tokens)
+
+	// Run every head over every datapoint, writing each head's output into its own rows of the combined output.
+	attentions := make([]*mat.Dense, batchSize*layer.Heads)
+	combined := mat.NewDense(layer.Heads*layer.ValueSize, numTokens*batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		for h := 0; h < layer.Heads; h++ {
+			query := queries.Slice(h*layer.KeySize, (h+1)*layer.KeySize, b*numTokens, (b+1)*numTokens)
+			key := keys.Slice(h*layer.KeySize, (h+1)*layer.KeySize, b*numTokens, (b+1)*numTokens)
+			value := values.Slice(h*layer.ValueSize, (h+1)*layer.ValueSize, b*numTokens, (b+1)*numTokens)
+
+			// Row i of the attention holds how much query i pulls from every key.
+			attention := mat.NewDense(numTokens, numTokens, nil)
+			attention.Mul(query.T(), key)
+			attention.Apply(func(i, j int, v float64) float64 {
+				if layer.Causal && j > i {
+					return math.Inf(-1)
+				}
+				return v * scale
+			}, attention)
+			softmaxRows(attention)
+			attentions[b*layer.Heads+h] = attention
+
+			headOutput := combined.Slice(h*layer.ValueSize, (h+1)*layer.ValueSize, b*numTokens, (b+1)*numTokens).(*mat.Dense)
+			headOutput.Mul(value, attention.T())
+		}
+	}
+
+	output, _ := layer.outputProjection.Pass(combined)
+	return columnsToChunks(output, batchSize), &AttentionCache{
+		Tokens:     tokens,
+		Queries:    queries,
+		Keys:       keys,
+		Values:     values,
+		Attentions: attentions,
+		Combined:   combined,
+	}
+}
+
+func (layer *MultiHeadAttentionLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	attentionCache := cache.(*AttentionCache)
+	queries, keys, values := attentionCache.Queries, attentionCache.Keys, attentionCache.Values
+	_, batchSize := forwardGradients.Dims()
+	_, totalTokens := attentionCache.Tokens.Dims()
+	numTokens := totalTokens / batchSize
+	scale := 1 / math.Sqrt(float64(layer.KeySize))
+
+	outputShift, combinedGradients := layer.outputProjection.Back(&InputCache{Input: attentionCache.Combined}, chunksToColumns(forwardGradients, layer.OutputSize))
+
+	queryGradients, keyGradients, valueGradients := utils.DenseLike(queries), utils.DenseLike(keys), utils.DenseLike(values)
+	for b := 0; b < batchSize; b++ {
+		for h := 0; h < layer.Heads; h++ {
+			query := queries.Slice(h*layer.KeySize, (h+1)*layer.KeySize, b*numTokens, (b+1)*numTokens)
+			key := keys.Slice(h*layer.KeySize, (h+1)*layer.KeySize, b*numTokens, (b+1)*numTokens)
+			value := values.Slice(h*layer.ValueSize, (h+1)*layer.ValueSize, b*numTokens, (b+1)*numTokens)
+			headGradient := combinedGradients.Slice(h*layer.ValueSize, (h+1)*layer.ValueSize, b*numTokens, (b+1)*numTokens)
+			attention := attentionCache.Attentions[b*layer.Heads+h]
+
+			// The values' gradient, and the gradient with respect to the attention weights
+			valueGradient := valueGradients.Slice(h*layer.ValueSize, (h+1)*layer.ValueSize, b*numTokens, (b+1)*numTokens).(*mat.Dense)
+			valueGradient.Mul(headGradient, attention)
+
+			scoreGradient := mat.NewDense(numTokens, numTokens, nil)
+			scoreGradient.Mul(headGradient.T(), value)
+
+			// Back through the softmax of each row, and the scaling (masked scores have zero weight, so get no gradient)
+			for i := 0; i < numTokens; i++ {
+				gradientRow, attentionRow := scoreGradient.RawRowView(i), attention.RawRowView(i)
+				weightedSum := utils.Sum(utils.DoubleMap(gradientRow, attentionRow, func(g, a float64) float64 { return g * a }))
+				for j := range gradientRow {
+					gradientRow[j] = attentionRow[j] * (gradientRow[j] - weightedSum) * scale
+				}
+			}
+
+			queryGradient := queryGradients.Slice(h*layer.KeySize, (h+1)*layer.KeySize, b*numTokens, (b+1)*numTokens).(*mat.Dense)
+			queryGradient.Mul(key, scoreGradient.T())
+
+			keyGradient := keyGradients.Slice(h*layer.KeySize, (h+1)*layer.KeySize, b*numTokens, (b+1)*numTokens).(*mat.Dense)
+			keyGradient.Mul(query, scoreGradient)
+		}
+	}
+
+	tokenCache := &InputCache{Input: attentionCache.Tokens}
+	queryShift, queryPassback := layer.queryProjection.Back(tokenCache, queryGradients)
+	keyShift, keyPassback := layer.keyProjection.Back(tokenCache, keyGradients)
+	valueShift, valuePassback := layer.valueProjection.Back(tokenCache, valueGradients)
+
+	queryPassback.Add(queryPassback, keyPassback)
+	queryPassback.Add(queryPassback, valuePassback)
+
+	shifts := []ShiftType{queryShift, keyShift, valueShift, outputShift}
+	if !layer.DecoupledDecay {
+		for i, shift := range shifts {
+			weightShift := shift.(*WeightShift)
+			addPenaltyGradient(weightShift.weightShift, layer.projections()[i].weights, layer.L1, layer.L2, float64(batchSize))
+		}
+	}
+
+	return &AttentionShift{
+		queryShift:  shifts[0],
+		keyShift:    shifts[1],
+		valueShift:  shifts[2],
+		outputShift: shifts[3],
+	}, columnsToChunks(queryPassback, batchSize)
+}
+
+func (layer *MultiHeadAttentionLayer) Penalty() float64 {
+	penalty := 0.0
+	for _, projection := range layer.projections() {
+		penalty += weightPenalty(projection.weights, layer.L1, layer.L2)
+	}
+	return penalty
+}
+
+func (layer *MultiHeadAttentionLayer) NumOutputs() int {
+	if layer.ConstantLengthInput {
+		return layer.inputLength / layer.InputSize * layer.OutputSize
+	}
+	return -1
+}
+
+func (layer *MultiHeadAttentionLayer) NumParameters() int {
+	parameters := 0
+	for _, projection := range layer.projections() {
+		parameters += projection.NumParameters()
+	}
+	return parameters
+}
+
+func (layer *MultiHeadAttentionLayer) ToBytes() []byte {
+	queryBytes, keyBytes, valueBytes, outputBytes := layer.queryProjection.ToBytes(), layer.keyProjection.ToBytes(), layer.valueProjection.ToBytes(), layer.outputProjection.ToBytes()
+
+	saveBytes := save.ConstantsToBytes(layer.InputSize, layer.OutputSize, layer.Heads, layer.KeySize, layer.ValueSize, utils.BoolToInt(layer.Causal), utils.BoolToInt(layer.ConstantLengthInput), len(queryBytes), len(valueBytes))
+	saveBytes = append(saveBytes, queryBytes...)
+	saveBytes = append(saveBytes, keyBytes...)
+	saveBytes = append(saveBytes, valueBytes...)
+	return append(saveBytes, outputBytes...)
+}
+
+func (layer *MultiHeadAttentionLayer) FromBytes(bytes []byte) {
+	constInts, bytes := save.ConstantsFromBytes(bytes[:36]), bytes[36:]
+	layer.InputSize, layer.OutputSize, layer.Heads, layer.KeySize, layer.ValueSize = constInts[0], constInts[1], constInts[2], constInts[3], constInts[4]
+	layer.Causal, layer.ConstantLengthInput = constInts[5] != 0, constInts[6] != 0
+	queryLength, valueLength := constInts[7], constInts[8]
+
+	layer.queryProjection.FromBytes(bytes[:queryLength])
+	layer.keyProjection.FromBytes(bytes[queryLength : queryLength*2])
+	layer.valueProjection.FromBytes(bytes[queryLength*2 : queryLength*2+valueLength])
+	layer.outputProjection.FromBytes(bytes[queryLength*2+valueLength:])
+}
+
+func (layer *MultiHeadAttentionLayer) PrettyPrint() string {
+	ret := fmt.Sprintf("Multi-Head Attention Layer\n%d Input Size -> %d Output Size, %d Heads (%d Key Size, %d Value Size)", layer.InputSize, layer.OutputSize, layer.Heads, layer.KeySize, layer.ValueSize)
+	if layer.Causal {
+		ret += ", Causal"
+	}
+	ret += "\n\n\nQuery Projection:\n" + layer.queryProjection.PrettyPrint()
+	ret += "\n\nKey Projection:\n" + layer.keyProjection.PrettyPrint()
+	ret += "\n\nValue Projection:\n" + layer.valueProjection.PrettyPrint()
+	ret += "\n\nOutput Projection:\n" + layer.outputProjection.PrettyPrint()
+	return ret
+}
+
+/*
+The shift type for MultiHeadAttention Layers.
+*/
+type AttentionShift struct {
+	queryShift  ShiftType
+	keyShift    ShiftType
+	valueShift  ShiftType
+	outputShift ShiftType
+}
+
+func (a *AttentionShift) shifts() []ShiftType {
+	return []ShiftType{a.queryShift, a.keyShift, a.valueShift, a.outputShift}
+}
+
+func (a *AttentionShift) Apply(layer Layer, scale float64) {
+	attentionLayer := layer.(*MultiHeadAttentionLayer)
+	for i, projection := range attentionLayer.projections() {
+		if attentionLayer.DecoupledDecay {
+			decayWeights(projection.weights, attentionLayer.L1, attentionLayer.L2, scale)
+		}
+		a.shifts()[i].Apply(projection, scale)
+	}
+}
+
+func (a *AttentionShift) Combine(a2 ShiftType) ShiftType {
+	attention2 := a2.(*AttentionShift)
+	a.queryShift = a.queryShift.Combine(attention2.queryShift)
+	a.keyShift = a.keyShift.Combine(attention2.keyShift)
+	a.valueShift = a.valueShift.Combine(attention2.valueShift)
+	a.outputShift = a.outputShift.Combine(attention2.outputShift)
+	return a
+}
+
+func (a *AttentionShift) Optimize(opt optimizers.Optimizer, index int) {
+	for i, shift := range a.shifts() {
+		shift.Optimize(opt, index+2*i)
+	}
+}
+
+func (a *AttentionShift) NumMatrices() int {
+	return 8
+}
+
+func (a *AttentionShift) Scale(f float64) {
+	for _, shift := range a.shifts() {
+		shift.Scale(f)
+	}
+}
+
+func (a *AttentionShift) SquaredNorm() float64 {
+	norm := 0.0
+	for _, shift := range a.shifts() {
+		norm += shift.SquaredNorm()
+	}
+	return norm
+}
+
+func (a *AttentionShift) Clip(limit float64) {
+	for _, shift := range a.shifts() {
+		shift.Clip(limit)
+	}
+}
@@ -0,0 +1,256 @@
+package layers
+
+import (
+	"fmt"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Feeds the same input through each of the Branches side by side, like the towers of an Inception block, where each
+branch is its own stack of layers. By default the outputs of the branches are concatenated, one after another in the
+order the Branches are given, so branches of Conv2DLayers that keep the same channel shape have their channels
+stacked together; if Sum is set the outputs are added together instead, which needs every branch to output the same
+number of values. A branch with no layers in it just passes the input along as it is.
+
+The gradient is split back up between the branches the same way, and what each branch passes back is added together.
+The channel shape from a Conv2DLayer before it is handed to every branch, and handed on to the layers after if all
+of the branches agree on it.
+*/
+type ParallelLayer struct {
+	Branches [][]Layer
+	Sum      bool
+
+	inputShape  Shape
+	outputShape Shape
+	numOutputs  int
+}
+
+func (layer *ParallelLayer) Initialize(numInputs int) {
+	if len(layer.Branches) == 0 {
+		panic("Give your ParallelLayer some Branches to run side by side!")
+	}
+
+	layer.numOutputs = 0
+	for i, branch := range layer.Branches {
+		branchOutputs, branchShape := initializeStack(branch, numInputs, layer.inputShape)
+
+		if i == 0 {
+			layer.outputShape = branchShape
+		} else if branchShape != layer.outputShape {
+			layer.outputShape = Shape{}
+		}
+
+		switch {
+		case branchOutputs < 0 || layer.numOutputs < 0:
+			layer.numOutputs = -1
+		case layer.Sum && i > 0 && branchOutputs != layer.numOutputs:
+			panic(fmt.Sprintf("Branch %d of a summed ParallelLayer outputs %d values, but the ones before it output %d!", i, branchOutputs, layer.numOutputs))
+		case layer.Sum:
+			layer.numOutputs = branchOutputs
+		default:
+			layer.numOutputs += branchOutputs
+		}
+	}
+}
+
+func (layer *ParallelLayer) sublayers() []Layer {
+	sublayers := make([]Layer, 0)
+	for _, branch := range layer.Branches {
+		sublayers = append(sublayers, branch...)
+	}
+	return sublayers
+}
+
+func (layer *ParallelLayer) setInputShape(shape Shape) {
+	layer.inputShape = shape
+}
+
+func (layer *ParallelLayer) OutputShape() Shape {
+	return layer.outputShape
+}
+
+func (layer *ParallelLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	cache := &ParallelCache{BranchCaches: make([][]CacheType, len(layer.Branches)), BranchRows: make([]int, len(layer.Branches))}
+
+	outputs := make([]*mat.Dense, len(layer.Branches))
+	for i, branch := range layer.Branches {
+		cache.BranchCaches[i] = make([]CacheType, len(branch))
+		outputs[i] = input
+		for j, inner := range branch {
+			outputs[i], cache.BranchCaches[i][j] = inner.Pass(outputs[i])
+		}
+		cache.BranchRows[i], _ = outputs[i].Dims()
+	}
+
+	// Layers can hold onto (or just hand back) the matrices they output, so the merged output gets a matrix of its own
+	_, batchSize := input.Dims()
+	if layer.Sum {
+		summed := mat.NewDense(cache.BranchRows[0], batchSize, nil)
+		for _, output := range outputs {
+			summed.Add(summed, output)
+		}
+		return summed, cache
+	}
+
+	concatenated, row := mat.NewDense(utils.Sum(cache.BranchRows), batchSize, nil), 0
+	for i, output := range outputs {
+		concatenated.Slice(row, row+cache.BranchRows[i], 0, batchSize).(*mat.Dense).Copy(output)
+		row += cache.BranchRows[i]
+	}
+	return concatenated, cache
+}
+
+func (layer *ParallelLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	parallelCache := cache.(*ParallelCache)
+	_, batchSize := forwardGradients.Dims()
+	shift := &ParallelShift{branchShifts: make([][]ShiftType, len(layer.Branches))}
+
+	var passback *mat.Dense
+	row := 0
+	for i, branch := range layer.Branches {
+		// Each branch gets its own copy of its part of the gradients, since layers are free to change them in place.
+		var branchGradients *mat.Dense
+		if layer.Sum {
+			branchGradients = mat.DenseCopyOf(forwardGradients)
+		} else {
+			branchGradients = mat.DenseCopyOf(forwardGradients.Slice(row, row+parallelCache.BranchRows[i], 0, batchSize))
+			row += parallelCache.BranchRows[i]
+		}
+
+		shift.branchShifts[i] = make([]ShiftType, len(branch))
+		for j := len(branch) - 1; j >= 0; j-- {
+			shift.branchShifts[i][j], branchGradients = branch[j].Back(parallelCache.BranchCaches[i][j], branchGradients)
+		}
+
+		if passback == nil {
+			passback = branchGradients
+		} else {
+			passback.Add(passback, branchGradients)
+		}
+	}
+
+	return shift, passback
+}
+
+func (layer *ParallelLayer) SetTraining(training bool) {
+	SetTraining(layer.sublayers(), training)
+}
+
+func (layer *ParallelLayer) Penalty() float64 {
+	return Penalty(layer.sublayers())
+}
+
+func (layer *ParallelLayer) NumOutputs() int {
+	return layer.numOutputs
+}
+
+func (layer *ParallelLayer) NumParameters() int {
+	return NumParameters(layer.sublayers())
+}
+
+func (layer *ParallelLayer) ToBytes() []byte {
+	bytes := save.ConstantsToBytes(utils.BoolToInt(layer.Sum), len(layer.Branches))
+	for _, branch := range layer.Branches {
+		bytes = append(bytes, stackToBytes(branch)...)
+	}
+	return bytes
+}
+
+func (layer *ParallelLayer) FromBytes(bytes []byte) {
+	constants, bytes := save.ConstantsFromBytes(bytes[:8]), bytes[8:]
+	layer.Sum = constants[0] != 0
+
+	layer.Branches = make([][]Layer, constants[1])
+	for i := range layer.Branches {
+		layer.Branches[i], bytes = stackFromBytes(bytes)
+	}
+}
+
+func (layer *ParallelLayer) PrettyPrint() string {
+	joined := "Concatenated"
+	if layer.Sum {
+		joined = "Summed"
+	}
+	ret := fmt.Sprintf("Parallel Layer (%d branches, %s)\n\n", len(layer.Branches), joined)
+	for i, branch := range layer.Branches {
+		ret += fmt.Sprintf("\n\nBranch %d:\n", i)
+		for _, inner := range branch {
+			ret += inner.PrettyPrint() + "\n"
+		}
+	}
+	return ret
+}
+
+/*
+The shift type for Parallel Layers, which holds the shifts of every layer in each of the branches.
+*/
+type ParallelShift struct {
+	branchShifts [][]ShiftType
+}
+
+func (p *ParallelShift) shifts() []ShiftType {
+	shifts := make([]ShiftType, 0)
+	for _, branchShifts := range p.branchShifts {
+		shifts = append(shifts, branchShifts...)
+	}
+	return shifts
+}
+
+func (p *ParallelShift) Apply(layer Layer, scale float64) {
+	parallelLayer := layer.(*ParallelLayer)
+	for i, branch := range parallelLayer.Branches {
+		for j, inner := range branch {
+			p.branchShifts[i][j].Apply(inner, scale)
+		}
+	}
+}
+
+func (p *ParallelShift) Combine(p2 ShiftType) ShiftType {
+	parallel2 := p2.(*ParallelShift)
+	for i := range p.branchShifts {
+		for j := range p.branchShifts[i] {
+			p.branchShifts[i][j] = p.branchShifts[i][j].Combine(parallel2.branchShifts[i][j])
+		}
+	}
+	return p
+}
+
+func (p *ParallelShift) Optimize(opt optimizers.Optimizer, index int) {
+	for _, shift := range p.shifts() {
+		shift.Optimize(opt, index)
+		index += shift.NumMatrices()
+	}
+}
+
+func (p *ParallelShift) NumMatrices() int {
+	numMatrices := 0
+	for _, shift := range p.shifts() {
+		numMatrices += shift.NumMatrices()
+	}
+	return numMatrices
+}
+
+func (p *ParallelShift) Scale(f float64) {
+	for _, shift := range p.shifts() {
+		shift.Scale(f)
+	}
+}
+
+func (p *ParallelShift) SquaredNorm() float64 {
+	norm := 0.0
+	for _, shift := range p.shifts() {
+		norm += shift.SquaredNorm()
+	}
+	return norm
+}
+
+func (p *ParallelShift) Clip(limit float64) {
+	for _, shift := range p.shifts() {
+		shift.Clip(limit)
+	}
+}
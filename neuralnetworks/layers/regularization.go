@@ -0,0 +1,64 @@
+package layers
+
+import (
+	"math"
+
+	"github.com/EganBoschCodes/lossless/utils"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Layers that penalize the size of their weights (through their L1 and L2 fields) implement Regularized,
+so that networks can add the penalty onto the loss they report.
+
+Penalty () float64: Gets L1 times the sum of the absolute values of the weights, plus L2 times half the
+sum of their squares. Biases are never penalized.
+
+By default the penalty's gradient is added into the shift during Back, once for every datapoint in
+the batch (just like the loss is), so it goes through the optimizer with the rest of the gradient.
+Setting DecoupledDecay on a layer instead shrinks the weights directly when the shift is applied,
+scaled by the learning rate, which keeps optimizers like Adam from rescaling the decay away.
+*/
+type Regularized interface {
+	Penalty() float64
+}
+
+// Adds up the penalties of every layer in the stack that has one.
+func Penalty(stack []Layer) float64 {
+	penalty := 0.0
+	for _, layer := range stack {
+		if regularized, ok := layer.(Regularized); ok {
+			penalty += regularized.Penalty()
+		}
+	}
+	return penalty
+}
+
+func weightPenalty(weights *mat.Dense, l1 float64, l2 float64) float64 {
+	if l1 == 0 && l2 == 0 {
+		return 0
+	}
+	raw, penalty := weights.RawMatrix(), 0.0
+	for r := 0; r < raw.Rows; r++ {
+		for _, w := range raw.Data[r*raw.Stride : r*raw.Stride+raw.Cols] {
+			penalty += l1*math.Abs(w) + l2*w*w/2
+		}
+	}
+	return penalty
+}
+
+// Adds the direction that shrinks the penalty on the weights into the shift, multiplied by times.
+func addPenaltyGradient(shift *mat.Dense, weights *mat.Dense, l1 float64, l2 float64, times float64) {
+	if l1 == 0 && l2 == 0 {
+		return
+	}
+	shift.Apply(func(r, c int, v float64) float64 {
+		w := weights.At(r, c)
+		return v - times*(l1*utils.Sign(w)+l2*w)
+	}, shift)
+}
+
+// Shrinks the weights in place, for when the penalty is decoupled from the gradient.
+func decayWeights(weights *mat.Dense, l1 float64, l2 float64, scale float64) {
+	addPenaltyGradient(weights, weights, l1, l2, scale)
+}
@@ -0,0 +1,210 @@
+package layers
+
+import (
+	"fmt"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+A skip connection around a stack of Layers, like the blocks of a ResNet; the input goes through each of the Layers
+in order, and then the input itself is added onto whatever comes out the end, so the Layers only have to learn how
+to change the input rather than how to rebuild it. The gradient goes back both ways as well, through the Layers and
+straight around them, which keeps it from fading away in very deep networks.
+
+If the Layers don't output as many values as they are given, the input has to be run through a Projection before
+it can be added on; this can be any layer (a 1x1 Conv2DLayer with a Stride is the usual choice after convolutions),
+and if none is given a LinearLayer is made to do it. The channel shape from a Conv2DLayer before the block is handed
+on to the Layers and the Projection, and whatever shape comes out of the Layers is handed on to the layers after.
+*/
+type ResidualLayer struct {
+	Layers     []Layer
+	Projection Layer
+
+	inputShape  Shape
+	outputShape Shape
+	numOutputs  int
+}
+
+func (layer *ResidualLayer) Initialize(numInputs int) {
+	if len(layer.Layers) == 0 {
+		panic("Give your ResidualLayer some Layers to skip around!")
+	}
+
+	layer.numOutputs, layer.outputShape = initializeStack(layer.Layers, numInputs, layer.inputShape)
+
+	if layer.Projection == nil && layer.numOutputs >= 0 && layer.numOutputs != numInputs {
+		layer.Projection = &LinearLayer{Outputs: layer.numOutputs}
+	}
+	if layer.Projection != nil {
+		if projectionOutputs, _ := initializeStack(layer.projection(), numInputs, layer.inputShape); projectionOutputs != layer.numOutputs {
+			panic(fmt.Sprintf("The Projection of a ResidualLayer outputs %d values, but its Layers output %d!", projectionOutputs, layer.numOutputs))
+		}
+	}
+}
+
+// Gets the Projection on its own in a stack, which is empty if the input is added on as it is.
+func (layer *ResidualLayer) projection() []Layer {
+	if layer.Projection == nil {
+		return []Layer{}
+	}
+	return []Layer{layer.Projection}
+}
+
+func (layer *ResidualLayer) sublayers() []Layer {
+	return append(append([]Layer{}, layer.Layers...), layer.projection()...)
+}
+
+func (layer *ResidualLayer) setInputShape(shape Shape) {
+	layer.inputShape = shape
+}
+
+func (layer *ResidualLayer) OutputShape() Shape {
+	return layer.outputShape
+}
+
+func (layer *ResidualLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	cache := &ResidualCache{LayerCaches: make([]CacheType, len(layer.Layers))}
+
+	output := input
+	for i, inner := range layer.Layers {
+		output, cache.LayerCaches[i] = inner.Pass(output)
+	}
+
+	skipped := input
+	if layer.Projection != nil {
+		skipped, cache.ProjectionCache = layer.Projection.Pass(input)
+	}
+
+	// Layers can hold onto (or just hand back) the matrices they output, so the sum gets a matrix of its own
+	summed := utils.DenseLike(output)
+	summed.Add(output, skipped)
+	return summed, cache
+}
+
+func (layer *ResidualLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	residualCache := cache.(*ResidualCache)
+	shift := &ResidualShift{layerShifts: make([]ShiftType, len(layer.Layers)), projectionShift: &NilShift{}}
+
+	// Back through the Layers with a copy of the gradients, since they're also needed to go around them.
+	passback := mat.DenseCopyOf(forwardGradients)
+	for i := len(layer.Layers) - 1; i >= 0; i-- {
+		shift.layerShifts[i], passback = layer.Layers[i].Back(residualCache.LayerCaches[i], passback)
+	}
+
+	skippedGradients := forwardGradients
+	if layer.Projection != nil {
+		shift.projectionShift, skippedGradients = layer.Projection.Back(residualCache.ProjectionCache, forwardGradients)
+	}
+	passback.Add(passback, skippedGradients)
+
+	return shift, passback
+}
+
+func (layer *ResidualLayer) SetTraining(training bool) {
+	SetTraining(layer.sublayers(), training)
+}
+
+func (layer *ResidualLayer) Penalty() float64 {
+	return Penalty(layer.sublayers())
+}
+
+func (layer *ResidualLayer) NumOutputs() int {
+	return layer.numOutputs
+}
+
+func (layer *ResidualLayer) NumParameters() int {
+	return NumParameters(layer.sublayers())
+}
+
+func (layer *ResidualLayer) ToBytes() []byte {
+	return append(stackToBytes(layer.Layers), stackToBytes(layer.projection())...)
+}
+
+func (layer *ResidualLayer) FromBytes(bytes []byte) {
+	layer.Layers, bytes = stackFromBytes(bytes)
+	projection, _ := stackFromBytes(bytes)
+
+	layer.Projection = nil
+	if len(projection) > 0 {
+		layer.Projection = projection[0]
+	}
+}
+
+func (layer *ResidualLayer) PrettyPrint() string {
+	ret := fmt.Sprintf("Residual Layer (%d layers)\n\n", len(layer.Layers))
+	for _, inner := range layer.Layers {
+		ret += inner.PrettyPrint() + "\n"
+	}
+	if layer.Projection != nil {
+		ret += "\nProjection:\n" + layer.Projection.PrettyPrint()
+	}
+	return ret
+}
+
+/*
+The shift type for Residual Layers, which holds the shifts of each of the inner layers and the projection.
+*/
+type ResidualShift struct {
+	layerShifts     []ShiftType
+	projectionShift ShiftType
+}
+
+func (r *ResidualShift) shifts() []ShiftType {
+	return append(append([]ShiftType{}, r.layerShifts...), r.projectionShift)
+}
+
+func (r *ResidualShift) Apply(layer Layer, scale float64) {
+	residualLayer := layer.(*ResidualLayer)
+	for i, inner := range residualLayer.Layers {
+		r.layerShifts[i].Apply(inner, scale)
+	}
+	r.projectionShift.Apply(residualLayer.Projection, scale)
+}
+
+func (r *ResidualShift) Combine(r2 ShiftType) ShiftType {
+	residual2 := r2.(*ResidualShift)
+	for i := range r.layerShifts {
+		r.layerShifts[i] = r.layerShifts[i].Combine(residual2.layerShifts[i])
+	}
+	r.projectionShift = r.projectionShift.Combine(residual2.projectionShift)
+	return r
+}
+
+func (r *ResidualShift) Optimize(opt optimizers.Optimizer, index int) {
+	for _, shift := range r.shifts() {
+		shift.Optimize(opt, index)
+		index += shift.NumMatrices()
+	}
+}
+
+func (r *ResidualShift) NumMatrices() int {
+	numMatrices := 0
+	for _, shift := range r.shifts() {
+		numMatrices += shift.NumMatrices()
+	}
+	return numMatrices
+}
+
+func (r *ResidualShift) Scale(f float64) {
+	for _, shift := range r.shifts() {
+		shift.Scale(f)
+	}
+}
+
+func (r *ResidualShift) SquaredNorm() float64 {
+	norm := 0.0
+	for _, shift := range r.shifts() {
+		norm += shift.SquaredNorm()
+	}
+	return norm
+}
+
+func (r *ResidualShift) Clip(limit float64) {
+	for _, shift := range r.shifts() {
+		shift.Clip(limit)
+	}
+}
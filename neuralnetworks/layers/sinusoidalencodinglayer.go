@@ -0,0 +1,65 @@
+package layers
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Adds the fixed sine and cosine position encodings from the original transformer paper onto a sequence of tokens
+InputSize long, so that the layers after it can tell where in the sequence each token is. It has nothing to learn,
+and works on sequences of any length.
+*/
+type SinusoidalEncodingLayer struct {
+	InputSize int
+
+	n_inputs int
+}
+
+func (layer *SinusoidalEncodingLayer) Initialize(n_inputs int) {
+	if layer.InputSize == 0 {
+		panic("You must specify how large each token going into a SinusoidalEncodingLayer is!")
+	}
+	layer.n_inputs = n_inputs
+}
+
+// The encoding for the i'th value of the token at the given position.
+func (layer *SinusoidalEncodingLayer) encoding(position int, i int) float64 {
+	angle := float64(position) / math.Pow(10000, float64(i-i%2)/float64(layer.InputSize))
+	if i%2 == 0 {
+		return math.Sin(angle)
+	}
+	return math.Cos(angle)
+}
+
+func (layer *SinusoidalEncodingLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	output := mat.DenseCopyOf(input)
+	output.Apply(func(r, _ int, v float64) float64 {
+		return v + layer.encoding(r/layer.InputSize, r%layer.InputSize)
+	}, output)
+	return output, nil
+}
+
+func (layer *SinusoidalEncodingLayer) Back(_ CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	return &NilShift{}, forwardGradients
+}
+
+func (layer *SinusoidalEncodingLayer) NumOutputs() int {
+	return layer.n_inputs
+}
+
+func (layer *SinusoidalEncodingLayer) ToBytes() []byte {
+	return save.ConstantsToBytes(layer.InputSize)
+}
+
+func (layer *SinusoidalEncodingLayer) FromBytes(bytes []byte) {
+	layer.InputSize = save.ConstantsFromBytes(bytes)[0]
+}
+
+func (layer *SinusoidalEncodingLayer) PrettyPrint() string {
+	return fmt.Sprintf("Sinusoidal Encoding Layer (%d Input Size)\n", layer.InputSize)
+}
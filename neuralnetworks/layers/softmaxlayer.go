@@ -18,15 +18,20 @@ func (layer *SoftmaxLayer) Initialize(n_inputs int) {
 }
 
 func (layer *SoftmaxLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
-	inputSlice := input.RawMatrix().Data
-	maxVal := utils.Reduce(inputSlice, math.Max)
+	r, c := input.Dims()
+	output := mat.NewDense(r, c, nil)
 
-	expSlice := utils.Map(inputSlice, func(a float64) float64 { return math.Exp(a - maxVal) })
-	sumExps := utils.Reduce(expSlice, func(a float64, b float64) float64 { return a + b })
-	expSlice = utils.Map(expSlice, func(a float64) float64 { return a / sumExps })
+	// Each column is its own datapoint, so each gets its own softmax
+	for j := 0; j < c; j++ {
+		inputSlice := mat.Col(nil, j, input)
+		maxVal := utils.Reduce(inputSlice, math.Max)
 
-	r, c := input.Dims()
-	output := mat.NewDense(r, c, expSlice)
+		expSlice := utils.Map(inputSlice, func(a float64) float64 { return math.Exp(a - maxVal) })
+		sumExps := utils.Reduce(expSlice, func(a float64, b float64) float64 { return a + b })
+		expSlice = utils.Map(expSlice, func(a float64) float64 { return a / sumExps })
+
+		output.SetCol(j, expSlice)
+	}
 
 	return output, &OutputCache{Output: output}
 }
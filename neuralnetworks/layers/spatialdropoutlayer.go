@@ -0,0 +1,100 @@
+package layers
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Dropout for the channels output by a Conv2DLayer; while training, each whole channel is zeroed out
+with probability Rate rather than each value on its own, since neighbouring values in a channel are
+too closely related for dropping them one at a time to do much. Like MaxPool2DLayer, the InputShape
+(the shape of each channel) is picked up automatically from a Conv2DLayer before it.
+*/
+type SpatialDropoutLayer struct {
+	Rate       float64
+	InputShape Shape
+
+	n_inputs int
+	training bool
+}
+
+func (layer *SpatialDropoutLayer) Initialize(n_inputs int) {
+	if layer.Rate < 0 || layer.Rate >= 1 {
+		panic(fmt.Sprintf("A SpatialDropoutLayer's Rate must be at least 0 and less than 1, not %.2f!", layer.Rate))
+	}
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		fmt.Println("A SpatialDropoutLayer needs to come after a Conv2DLayer, or be given an InputShape!")
+		panic(1)
+	}
+	if n_inputs%(layer.InputShape.Rows*layer.InputShape.Cols) != 0 {
+		fmt.Printf("%d outputs from the last layer can't be split into %dx%d channels!\n", n_inputs, layer.InputShape.Rows, layer.InputShape.Cols)
+		panic(1)
+	}
+	layer.n_inputs = n_inputs
+}
+
+func (layer *SpatialDropoutLayer) setInputShape(shape Shape) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = shape
+	}
+}
+
+func (layer *SpatialDropoutLayer) SetTraining(training bool) {
+	layer.training = training
+}
+
+func (layer *SpatialDropoutLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	if !layer.training || layer.Rate == 0 {
+		return input, &DropoutCache{}
+	}
+
+	// Decide which channels of each datapoint to keep, then spread that over every value in the channel.
+	channelSize := layer.InputShape.Rows * layer.InputShape.Cols
+	rows, batchSize := input.Dims()
+	mask := mat.NewDense(rows, batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		for channel := 0; channel < rows/channelSize; channel++ {
+			if rand.Float64() < layer.Rate {
+				continue
+			}
+			for i := channel * channelSize; i < (channel+1)*channelSize; i++ {
+				mask.Set(i, b, 1/(1-layer.Rate))
+			}
+		}
+	}
+
+	output := mat.NewDense(rows, batchSize, nil)
+	output.MulElem(input, mask)
+	return output, &DropoutCache{Mask: mask}
+}
+
+func (layer *SpatialDropoutLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	mask := cache.(*DropoutCache).Mask
+	if mask != nil {
+		forwardGradients.MulElem(forwardGradients, mask)
+	}
+	return &NilShift{}, forwardGradients
+}
+
+func (layer *SpatialDropoutLayer) NumOutputs() int {
+	return layer.n_inputs
+}
+
+func (layer *SpatialDropoutLayer) ToBytes() []byte {
+	saveBytes := save.ConstantsToBytes(layer.InputShape.Rows, layer.InputShape.Cols)
+	return append(saveBytes, save.ToBytes([]float64{layer.Rate})...)
+}
+
+func (layer *SpatialDropoutLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes[:8])
+	layer.InputShape = Shape{Rows: constInts[0], Cols: constInts[1]}
+	layer.Rate = save.FromBytes(bytes[8:])[0]
+}
+
+func (layer *SpatialDropoutLayer) PrettyPrint() string {
+	return fmt.Sprintf("Spatial Dropout (%.2f)\n", layer.Rate)
+}
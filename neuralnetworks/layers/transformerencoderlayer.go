@@ -0,0 +1,239 @@
+package layers
+
+import (
+	"fmt"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+One block of a transformer encoder, laid out like in the original paper. The input is read as a sequence of tokens
+InputSize long, and goes through multi-head self-attention, which is added back onto the input and layer normalized.
+Each token then goes through its own feed-forward network (a hidden layer of FeedForwardSize, 4 * InputSize by
+default, with a relu activation), which is again added back on and layer normalized. Heads and Causal are passed
+on to the attention, and the weight penalties cover the attention's projections as well as the feed-forward network.
+*/
+type TransformerEncoderLayer struct {
+	InputSize       int
+	Heads           int
+	FeedForwardSize int
+	Causal          bool
+
+	ConstantLengthInput bool
+
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
+	attention       MultiHeadAttentionLayer
+	attentionNorm   LayerNormLayer
+	feedForwardIn   LinearLayer
+	feedForwardOut  LinearLayer
+	feedForwardNorm LayerNormLayer
+}
+
+func (layer *TransformerEncoderLayer) Initialize(numInputs int) {
+	if layer.InputSize == 0 {
+		panic("You must specify how large each token going into a TransformerEncoderLayer is!")
+	}
+	if layer.FeedForwardSize == 0 {
+		layer.FeedForwardSize = 4 * layer.InputSize
+	}
+
+	layer.attention.InputSize, layer.attention.Heads, layer.attention.Causal = layer.InputSize, layer.Heads, layer.Causal
+	layer.attention.ConstantLengthInput = layer.ConstantLengthInput
+	layer.attention.L1, layer.attention.L2, layer.attention.DecoupledDecay = layer.L1, layer.L2, layer.DecoupledDecay
+	layer.attention.Initialize(numInputs)
+	layer.Heads = layer.attention.Heads
+
+	layer.attentionNorm.InputSize, layer.feedForwardNorm.InputSize = layer.InputSize, layer.InputSize
+	layer.attentionNorm.Initialize(numInputs)
+	layer.feedForwardNorm.Initialize(numInputs)
+
+	layer.feedForwardIn.Outputs, layer.feedForwardOut.Outputs = layer.FeedForwardSize, layer.InputSize
+	layer.feedForwardIn.Initialize(layer.InputSize)
+	layer.feedForwardOut.Initialize(layer.FeedForwardSize)
+}
+
+func (layer *TransformerEncoderLayer) sublayers() []Layer {
+	return []Layer{&layer.attention, &layer.attentionNorm, &layer.feedForwardIn, &layer.feedForwardOut, &layer.feedForwardNorm}
+}
+
+func (layer *TransformerEncoderLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	_, batchSize := input.Dims()
+
+	// Self-attention, added back onto the input and normalized
+	attended, attentionCache := layer.attention.Pass(input)
+	attended.Add(attended, input)
+	normed, attentionNormCache := layer.attentionNorm.Pass(attended)
+
+	// The feed-forward network runs on every token on its own, so the tokens are passed through it as one big batch.
+	tokens := chunksToColumns(normed, layer.InputSize)
+	hidden, _ := layer.feedForwardIn.Pass(tokens)
+	activated := utils.DenseLike(hidden)
+	activated.Apply(func(_, _ int, v float64) float64 {
+		if v < 0 {
+			return 0
+		}
+		return v
+	}, hidden)
+	fedForward, _ := layer.feedForwardOut.Pass(activated)
+
+	output := columnsToChunks(fedForward, batchSize)
+	output.Add(output, normed)
+	output, feedForwardNormCache := layer.feedForwardNorm.Pass(output)
+
+	return output, &TransformerCache{
+		AttentionCache:       attentionCache,
+		AttentionNormCache:   attentionNormCache,
+		FeedForwardNormCache: feedForwardNormCache,
+		Tokens:               tokens,
+		Hidden:               hidden,
+		Activated:            activated,
+	}
+}
+
+func (layer *TransformerEncoderLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	transformerCache := cache.(*TransformerCache)
+	_, batchSize := forwardGradients.Dims()
+
+	// Back through the feed-forward half, where the gradient goes both through the network and straight around it
+	feedForwardNormShift, normedGradients := layer.feedForwardNorm.Back(transformerCache.FeedForwardNormCache, forwardGradients)
+
+	feedForwardOutShift, activatedGradients := layer.feedForwardOut.Back(&InputCache{Input: transformerCache.Activated}, chunksToColumns(normedGradients, layer.InputSize))
+	activatedGradients.Apply(func(i, j int, v float64) float64 {
+		if transformerCache.Hidden.At(i, j) <= 0 {
+			return 0
+		}
+		return v
+	}, activatedGradients)
+	feedForwardInShift, tokenGradients := layer.feedForwardIn.Back(&InputCache{Input: transformerCache.Tokens}, activatedGradients)
+	normedGradients.Add(normedGradients, columnsToChunks(tokenGradients, batchSize))
+
+	// Then back through the attention half in the same way
+	attentionNormShift, attendedGradients := layer.attentionNorm.Back(transformerCache.AttentionNormCache, normedGradients)
+	attentionShift, inputGradients := layer.attention.Back(transformerCache.AttentionCache, attendedGradients)
+	inputGradients.Add(inputGradients, attendedGradients)
+
+	if !layer.DecoupledDecay {
+		addPenaltyGradient(feedForwardInShift.(*WeightShift).weightShift, layer.feedForwardIn.weights, layer.L1, layer.L2, float64(batchSize))
+		addPenaltyGradient(feedForwardOutShift.(*WeightShift).weightShift, layer.feedForwardOut.weights, layer.L1, layer.L2, float64(batchSize))
+	}
+
+	return &TransformerShift{
+		attentionShift:       attentionShift,
+		attentionNormShift:   attentionNormShift,
+		feedForwardInShift:   feedForwardInShift,
+		feedForwardOutShift:  feedForwardOutShift,
+		feedForwardNormShift: feedForwardNormShift,
+	}, inputGradients
+}
+
+func (layer *TransformerEncoderLayer) Penalty() float64 {
+	penalty := layer.attention.Penalty()
+	penalty += weightPenalty(layer.feedForwardIn.weights, layer.L1, layer.L2)
+	penalty += weightPenalty(layer.feedForwardOut.weights, layer.L1, layer.L2)
+	return penalty
+}
+
+func (layer *TransformerEncoderLayer) NumOutputs() int {
+	return layer.attention.NumOutputs()
+}
+
+func (layer *TransformerEncoderLayer) NumParameters() int {
+	return NumParameters(layer.sublayers())
+}
+
+func (layer *TransformerEncoderLayer) ToBytes() []byte {
+	saveBytes := save.ConstantsToBytes(layer.InputSize, layer.Heads, layer.FeedForwardSize, utils.BoolToInt(layer.Causal), utils.BoolToInt(layer.ConstantLengthInput))
+	return append(saveBytes, sublayersToBytes(layer.sublayers()...)...)
+}
+
+func (layer *TransformerEncoderLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes[:20])
+	layer.InputSize, layer.Heads, layer.FeedForwardSize = constInts[0], constInts[1], constInts[2]
+	layer.Causal, layer.ConstantLengthInput = constInts[3] != 0, constInts[4] != 0
+
+	sublayersFromBytes(bytes[20:], layer.sublayers()...)
+}
+
+func (layer *TransformerEncoderLayer) PrettyPrint() string {
+	ret := fmt.Sprintf("Transformer Encoder Layer\n%d Input Size, %d Heads, %d Feed Forward Size\n\n", layer.InputSize, layer.Heads, layer.FeedForwardSize)
+	ret += "\n\nAttention:\n" + layer.attention.PrettyPrint()
+	ret += "\n\nAttention Norm:\n" + layer.attentionNorm.PrettyPrint()
+	ret += "\n\nFeed Forward In:\n" + layer.feedForwardIn.PrettyPrint()
+	ret += "\n\nFeed Forward Out:\n" + layer.feedForwardOut.PrettyPrint()
+	ret += "\n\nFeed Forward Norm:\n" + layer.feedForwardNorm.PrettyPrint()
+	return ret
+}
+
+/*
+The shift type for TransformerEncoder Layers, which holds the shifts of every part of the block.
+*/
+type TransformerShift struct {
+	attentionShift       ShiftType
+	attentionNormShift   ShiftType
+	feedForwardInShift   ShiftType
+	feedForwardOutShift  ShiftType
+	feedForwardNormShift ShiftType
+}
+
+func (t *TransformerShift) shifts() []ShiftType {
+	return []ShiftType{t.attentionShift, t.attentionNormShift, t.feedForwardInShift, t.feedForwardOutShift, t.feedForwardNormShift}
+}
+
+func (t *TransformerShift) Apply(layer Layer, scale float64) {
+	transformerLayer := layer.(*TransformerEncoderLayer)
+	if transformerLayer.DecoupledDecay {
+		decayWeights(transformerLayer.feedForwardIn.weights, transformerLayer.L1, transformerLayer.L2, scale)
+		decayWeights(transformerLayer.feedForwardOut.weights, transformerLayer.L1, transformerLayer.L2, scale)
+	}
+	for i, sublayer := range transformerLayer.sublayers() {
+		t.shifts()[i].Apply(sublayer, scale)
+	}
+}
+
+func (t *TransformerShift) Combine(t2 ShiftType) ShiftType {
+	transformer2 := t2.(*TransformerShift)
+	t.attentionShift = t.attentionShift.Combine(transformer2.attentionShift)
+	t.attentionNormShift = t.attentionNormShift.Combine(transformer2.attentionNormShift)
+	t.feedForwardInShift = t.feedForwardInShift.Combine(transformer2.feedForwardInShift)
+	t.feedForwardOutShift = t.feedForwardOutShift.Combine(transformer2.feedForwardOutShift)
+	t.feedForwardNormShift = t.feedForwardNormShift.Combine(transformer2.feedForwardNormShift)
+	return t
+}
+
+func (t *TransformerShift) Optimize(opt optimizers.Optimizer, index int) {
+	for _, shift := range t.shifts() {
+		shift.Optimize(opt, index)
+		index += shift.NumMatrices()
+	}
+}
+
+func (t *TransformerShift) NumMatrices() int {
+	return 16
+}
+
+func (t *TransformerShift) Scale(f float64) {
+	for _, shift := range t.shifts() {
+		shift.Scale(f)
+	}
+}
+
+func (t *TransformerShift) SquaredNorm() float64 {
+	norm := 0.0
+	for _, shift := range t.shifts() {
+		norm += shift.SquaredNorm()
+	}
+	return norm
+}
+
+func (t *TransformerShift) Clip(limit float64) {
+	for _, shift := range t.shifts() {
+		shift.Clip(limit)
+	}
+}
@@ -0,0 +1,177 @@
+package layers
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/utils"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+Upsampling can fill in the new values in one of two ways; "nearest" (the default) just repeats each value over a
+block of the output, while "bilinear" blends between the nearest values in each direction, treating every value
+as sitting at the center of the block it grows into (like most other libraries do by default).
+*/
+const (
+	NearestUpsampling  = "nearest"
+	BilinearUpsampling = "bilinear"
+)
+
+/*
+Grows each of the channels output by a Conv2DLayer by Factor, so a 2x2 Factor turns each 4x4 channel into an 8x8
+one. The InputShape is picked up automatically from a Conv2DLayer before it, and otherwise each datapoint is treated
+as one tall column. It has nothing to learn, and is usually followed by a Conv2DLayer with "same" padding as a
+cheaper (and less checkerboard-prone) alternative to a ConvTranspose2DLayer.
+*/
+type Upsample2DLayer struct {
+	Factor     Shape
+	InputShape Shape
+	Mode       string
+
+	n_inputs int
+	channels int
+	rowTaps  [][]upsampleTap
+	colTaps  [][]upsampleTap
+}
+
+// One of the input rows (or columns) that an output row (or column) is made from, and how much of it is used.
+type upsampleTap struct {
+	index  int
+	weight float64
+}
+
+func (layer *Upsample2DLayer) Initialize(n_inputs int) {
+	if layer.Factor.Rows == 0 || layer.Factor.Cols == 0 {
+		fmt.Println("You must specify the Factor to grow by for an Upsample2DLayer!")
+		panic(1)
+	}
+
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = Shape{Rows: n_inputs, Cols: 1}
+	}
+
+	if n_inputs%(layer.InputShape.Rows*layer.InputShape.Cols) != 0 {
+		fmt.Printf("%d outputs from the last layer can't be split into %dx%d channels!\n", n_inputs, layer.InputShape.Rows, layer.InputShape.Cols)
+		panic(1)
+	}
+
+	switch layer.Mode {
+	case "":
+		layer.Mode = NearestUpsampling
+	case NearestUpsampling, BilinearUpsampling:
+	default:
+		panic(fmt.Sprintf("\"%s\" isn't a kind of upsampling! Use \"%s\" or \"%s\".", layer.Mode, NearestUpsampling, BilinearUpsampling))
+	}
+
+	layer.n_inputs = n_inputs
+	layer.channels = n_inputs / (layer.InputShape.Rows * layer.InputShape.Cols)
+	layer.rowTaps = upsampleTaps(layer.InputShape.Rows, layer.Factor.Rows, layer.Mode)
+	layer.colTaps = upsampleTaps(layer.InputShape.Cols, layer.Factor.Cols, layer.Mode)
+}
+
+// Works out which of the size input rows (or columns) each of the size * factor output rows (or columns) is made from.
+func upsampleTaps(size int, factor int, mode string) [][]upsampleTap {
+	taps := make([][]upsampleTap, size*factor)
+	for i := range taps {
+		if mode == NearestUpsampling {
+			taps[i] = []upsampleTap{{index: i / factor, weight: 1}}
+			continue
+		}
+
+		// Find where the center of this output falls between the centers of the inputs, stopping at the edges.
+		position := math.Max((float64(i)+0.5)/float64(factor)-0.5, 0)
+		below := int(position)
+		if below >= size-1 {
+			taps[i] = []upsampleTap{{index: size - 1, weight: 1}}
+			continue
+		}
+		fraction := position - float64(below)
+		taps[i] = []upsampleTap{{index: below, weight: 1 - fraction}, {index: below + 1, weight: fraction}}
+	}
+	return taps
+}
+
+// Calls the function for every pairing of a position in an output channel with a position in the input channel it uses.
+func (layer *Upsample2DLayer) forEach(apply func(outputIndex int, inputIndex int, weight float64)) {
+	outputCols := len(layer.colTaps)
+	for r, rowTaps := range layer.rowTaps {
+		for c, colTaps := range layer.colTaps {
+			for _, rowTap := range rowTaps {
+				for _, colTap := range colTaps {
+					apply(r*outputCols+c, rowTap.index*layer.InputShape.Cols+colTap.index, rowTap.weight*colTap.weight)
+				}
+			}
+		}
+	}
+}
+
+func (layer *Upsample2DLayer) setInputShape(shape Shape) {
+	if layer.InputShape.Rows == 0 || layer.InputShape.Cols == 0 {
+		layer.InputShape = shape
+	}
+}
+
+func (layer *Upsample2DLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
+	_, batchSize := input.Dims()
+	inputLen, outputLen := layer.InputShape.Rows*layer.InputShape.Cols, len(layer.rowTaps)*len(layer.colTaps)
+
+	output := mat.NewDense(layer.NumOutputs(), batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		inputSlice, outputSlice := mat.Col(nil, b, input), make([]float64, layer.NumOutputs())
+		for c := 0; c < layer.channels; c++ {
+			channelInput, channelOutput := inputSlice[c*inputLen:(c+1)*inputLen], outputSlice[c*outputLen:(c+1)*outputLen]
+			layer.forEach(func(o, i int, weight float64) {
+				channelOutput[o] += weight * channelInput[i]
+			})
+		}
+		output.SetCol(b, outputSlice)
+	}
+	return output, nil
+}
+
+func (layer *Upsample2DLayer) Back(_ CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
+	_, batchSize := forwardGradients.Dims()
+	inputLen, outputLen := layer.InputShape.Rows*layer.InputShape.Cols, len(layer.rowTaps)*len(layer.colTaps)
+
+	backwardGradients := mat.NewDense(layer.n_inputs, batchSize, nil)
+	for b := 0; b < batchSize; b++ {
+		gradientSlice, passbackSlice := mat.Col(nil, b, forwardGradients), make([]float64, layer.n_inputs)
+		for c := 0; c < layer.channels; c++ {
+			channelGradients, channelPassback := gradientSlice[c*outputLen:(c+1)*outputLen], passbackSlice[c*inputLen:(c+1)*inputLen]
+			layer.forEach(func(o, i int, weight float64) {
+				channelPassback[i] += weight * channelGradients[o]
+			})
+		}
+		backwardGradients.SetCol(b, passbackSlice)
+	}
+	return &NilShift{}, backwardGradients
+}
+
+func (layer *Upsample2DLayer) NumOutputs() int {
+	return layer.n_inputs * layer.Factor.Rows * layer.Factor.Cols
+}
+
+func (layer *Upsample2DLayer) OutputShape() Shape {
+	return Shape{Rows: layer.InputShape.Rows * layer.Factor.Rows, Cols: layer.InputShape.Cols * layer.Factor.Cols}
+}
+
+func (layer *Upsample2DLayer) ToBytes() []byte {
+	return save.ConstantsToBytes(layer.Factor.Rows, layer.Factor.Cols, layer.InputShape.Rows, layer.InputShape.Cols, utils.BoolToInt(layer.Mode == BilinearUpsampling))
+}
+
+func (layer *Upsample2DLayer) FromBytes(bytes []byte) {
+	constInts := save.ConstantsFromBytes(bytes)
+	layer.Factor = Shape{Rows: constInts[0], Cols: constInts[1]}
+	layer.InputShape = Shape{Rows: constInts[2], Cols: constInts[3]}
+	layer.Mode = NearestUpsampling
+	if constInts[4] != 0 {
+		layer.Mode = BilinearUpsampling
+	}
+}
+
+func (layer *Upsample2DLayer) PrettyPrint() string {
+	return fmt.Sprintf("Upsample (%dx%d, %s)\n", layer.Factor.Rows, layer.Factor.Cols, layer.Mode)
+}
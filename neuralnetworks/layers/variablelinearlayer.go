@@ -20,6 +20,10 @@ type VariableLinearLayer struct {
 	ConstantLengthInput bool
 	inputLength         int
 
+	L1             float64
+	L2             float64
+	DecoupledDecay bool
+
 	weights *mat.Dense
 	biases  *mat.Dense
 }
@@ -56,48 +60,56 @@ func (layer *VariableLinearLayer) Initialize(numInputs int) {
 }
 
 func (layer *VariableLinearLayer) Pass(input *mat.Dense) (*mat.Dense, CacheType) {
-	inputSlice := utils.GetSlice(input)
-	outputSlice := make([]float64, 0)
+	inputRows, batchSize := input.Dims()
+	numChunks := inputRows / layer.InputSize
+	output := mat.NewDense(numChunks*layer.OutputSize, batchSize, nil)
 
-	for i := 0; i < len(inputSlice); i += layer.InputSize {
-		// Get the input chunk
-		inputChunk := utils.FromSlice(inputSlice[i : i+layer.InputSize])
+	for i := 0; i < numChunks; i++ {
+		// Get the input chunk, and the part of the output it maps to
+		inputChunk := input.Slice(i*layer.InputSize, (i+1)*layer.InputSize, 0, batchSize)
+		outputChunk := output.Slice(i*layer.OutputSize, (i+1)*layer.OutputSize, 0, batchSize).(*mat.Dense)
 
 		// Multiply by weights
-		outputChunk := mat.NewDense(layer.OutputSize, 1, nil)
 		outputChunk.Mul(layer.weights, inputChunk)
 
 		// Add biases
-		outputChunk.Add(outputChunk, layer.biases)
-		outputSlice = append(outputSlice, utils.GetSlice(outputChunk)...)
+		utils.AddToColumns(outputChunk, layer.biases)
 	}
 
-	return utils.FromSlice(outputSlice), &InputCache{Input: input}
+	return output, &InputCache{Input: input}
 }
 
 func (layer *VariableLinearLayer) Back(cache CacheType, forwardGradients *mat.Dense) (ShiftType, *mat.Dense) {
 	inputs := cache.(*InputCache).Input
-	inputSlice, gradientSlice := utils.GetSlice(inputs), utils.GetSlice(forwardGradients)
+	inputRows, batchSize := inputs.Dims()
+	numChunks := inputRows / layer.InputSize
 
 	weightShift, biasShift := mat.NewDense(layer.OutputSize, layer.InputSize, nil), mat.NewDense(layer.OutputSize, 1, nil)
-	backwardPass := make([]float64, 0)
-	for i := 0; i < len(inputSlice)/layer.InputSize; i++ {
+	backwardPass := mat.NewDense(inputRows, batchSize, nil)
+	chunkWeightShift := mat.NewDense(layer.OutputSize, layer.InputSize, nil)
+	for i := 0; i < numChunks; i++ {
 		// Get the input chunk
-		inputChunk, gradientChunk := utils.FromSlice(inputSlice[i*layer.InputSize:(i+1)*layer.InputSize]), utils.FromSlice(gradientSlice[i*layer.OutputSize:(i+1)*layer.OutputSize])
+		inputChunk := inputs.Slice(i*layer.InputSize, (i+1)*layer.InputSize, 0, batchSize)
+		gradientChunk := forwardGradients.Slice(i*layer.OutputSize, (i+1)*layer.OutputSize, 0, batchSize).(*mat.Dense)
 
-		chunkWeightShift := mat.NewDense(layer.OutputSize, layer.InputSize, nil)
 		chunkWeightShift.Mul(gradientChunk, inputChunk.T())
 
 		weightShift.Add(weightShift, chunkWeightShift)
-		biasShift.Add(biasShift, gradientChunk)
+		biasShift.Add(biasShift, utils.SumColumns(gradientChunk))
 
-		newGradient := mat.NewDense(layer.InputSize, 1, nil)
+		newGradient := backwardPass.Slice(i*layer.InputSize, (i+1)*layer.InputSize, 0, batchSize).(*mat.Dense)
 		newGradient.Mul(layer.weights.T(), gradientChunk)
+	}
 
-		backwardPass = append(backwardPass, utils.GetSlice(newGradient)...)
+	if !layer.DecoupledDecay {
+		addPenaltyGradient(weightShift, layer.weights, layer.L1, layer.L2, float64(batchSize))
 	}
 
-	return &WeightShift{weightShift: weightShift, biasShift: biasShift}, utils.FromSlice(backwardPass)
+	return &WeightShift{weightShift: weightShift, biasShift: biasShift}, backwardPass
+}
+
+func (layer *VariableLinearLayer) Penalty() float64 {
+	return weightPenalty(layer.weights, layer.L1, layer.L2)
 }
 
 func (layer *VariableLinearLayer) NumOutputs() int {
@@ -107,6 +119,10 @@ func (layer *VariableLinearLayer) NumOutputs() int {
 	return -1
 }
 
+func (layer *VariableLinearLayer) NumParameters() int {
+	return countParameters(layer.weights, layer.biases)
+}
+
 func (layer *VariableLinearLayer) ToBytes() []byte {
 	weightSlice, biasSlice := save.ToBytes(utils.GetSlice(layer.weights)), save.ToBytes(utils.GetSlice(layer.biases))
 	saveBytes := save.ConstantsToBytes(layer.InputSize, layer.OutputSize, utils.BoolToInt(layer.ConstantLengthInput), len(weightSlice)/8)
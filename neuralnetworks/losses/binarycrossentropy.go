@@ -0,0 +1,24 @@
+package losses
+
+import "math"
+
+// Binary cross-entropy, treating each output as its own independent probability (usually after a SigmoidLayer).
+type BinaryCrossEntropy struct{}
+
+func (bce *BinaryCrossEntropy) Loss(output []float64, target []float64) float64 {
+	loss := 0.0
+	for i := range output {
+		o := clamp(output[i], epsilon, 1-epsilon)
+		loss -= target[i]*math.Log(o) + (1-target[i])*math.Log(1-o)
+	}
+	return loss
+}
+
+func (bce *BinaryCrossEntropy) Gradient(output []float64, target []float64) []float64 {
+	gradient := make([]float64, len(output))
+	for i := range output {
+		o := clamp(output[i], epsilon, 1-epsilon)
+		gradient[i] = target[i]/o - (1-target[i])/(1-o)
+	}
+	return gradient
+}
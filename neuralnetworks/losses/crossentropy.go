@@ -0,0 +1,36 @@
+package losses
+
+import "math"
+
+// Categorical cross-entropy, for when the targets are a probability distribution (usually one-hot).
+type CrossEntropy struct{}
+
+func (ce *CrossEntropy) Loss(output []float64, target []float64) float64 {
+	loss := 0.0
+	for i := range output {
+		loss -= target[i] * math.Log(clamp(output[i], epsilon, 1))
+	}
+	return loss
+}
+
+func (ce *CrossEntropy) Gradient(output []float64, target []float64) []float64 {
+	gradient := make([]float64, len(output))
+	for i := range output {
+		gradient[i] = target[i] / clamp(output[i], epsilon, 1)
+	}
+	return gradient
+}
+
+// Paired with a softmax, the gradient with respect to the logits collapses down to this.
+func (ce *CrossEntropy) SoftmaxGradient(output []float64, target []float64) []float64 {
+	targetSum := 0.0
+	for _, t := range target {
+		targetSum += t
+	}
+
+	gradient := make([]float64, len(output))
+	for i := range output {
+		gradient[i] = target[i] - output[i]*targetSum
+	}
+	return gradient
+}
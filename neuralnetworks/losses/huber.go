@@ -0,0 +1,40 @@
+package losses
+
+import "math"
+
+// Quadratic for errors smaller than Delta, linear beyond it. Delta defaults to 1.
+type Huber struct {
+	Delta float64
+}
+
+func (h *Huber) delta() float64 {
+	if h.Delta == 0 {
+		return 1
+	}
+	return h.Delta
+}
+
+func (h *Huber) Loss(output []float64, target []float64) float64 {
+	delta := h.delta()
+
+	loss := 0.0
+	for i := range output {
+		diff := math.Abs(output[i] - target[i])
+		if diff <= delta {
+			loss += 0.5 * diff * diff
+		} else {
+			loss += delta * (diff - 0.5*delta)
+		}
+	}
+	return loss
+}
+
+func (h *Huber) Gradient(output []float64, target []float64) []float64 {
+	delta := h.delta()
+
+	gradient := make([]float64, len(output))
+	for i := range output {
+		gradient[i] = clamp(target[i]-output[i], -delta, delta)
+	}
+	return gradient
+}
@@ -0,0 +1,32 @@
+package losses
+
+import "math"
+
+/*
+LOSS - The interface for measuring how far a network's output is from its target.
+
+Loss (output []float64, target []float64) float64: Gets the loss of a single datapoint.
+
+Gradient (output []float64, target []float64) []float64: Gets the direction each output should be pushed to decrease the loss
+(the negative of the derivative of the loss), which is what gets passed back through the layers to start backprop.
+*/
+type Loss interface {
+	Loss([]float64, []float64) float64
+	Gradient([]float64, []float64) []float64
+}
+
+/*
+Losses that also implement SoftmaxLoss know how to take the gradient directly with respect
+to the inputs of a final SoftmaxLayer. When a network ends in a softmax and its loss implements
+this, the softmax layer's own backward pass is skipped in favor of this (much better behaved) one.
+*/
+type SoftmaxLoss interface {
+	SoftmaxGradient([]float64, []float64) []float64
+}
+
+// Used to keep logarithms and divisions away from zero.
+const epsilon = 1e-12
+
+func clamp(v float64, low float64, high float64) float64 {
+	return math.Max(low, math.Min(high, v))
+}
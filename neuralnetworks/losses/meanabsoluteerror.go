@@ -0,0 +1,27 @@
+package losses
+
+import "math"
+
+// The absolute error, summed across all the outputs.
+type MeanAbsoluteError struct{}
+
+func (mae *MeanAbsoluteError) Loss(output []float64, target []float64) float64 {
+	loss := 0.0
+	for i := range output {
+		loss += math.Abs(output[i] - target[i])
+	}
+	return loss
+}
+
+func (mae *MeanAbsoluteError) Gradient(output []float64, target []float64) []float64 {
+	gradient := make([]float64, len(output))
+	for i := range output {
+		switch {
+		case target[i] > output[i]:
+			gradient[i] = 1
+		case target[i] < output[i]:
+			gradient[i] = -1
+		}
+	}
+	return gradient
+}
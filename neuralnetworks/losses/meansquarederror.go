@@ -0,0 +1,20 @@
+package losses
+
+// Half the squared error, summed across all the outputs.
+type MeanSquaredError struct{}
+
+func (mse *MeanSquaredError) Loss(output []float64, target []float64) float64 {
+	loss := 0.0
+	for i := range output {
+		loss += 0.5 * (output[i] - target[i]) * (output[i] - target[i])
+	}
+	return loss
+}
+
+func (mse *MeanSquaredError) Gradient(output []float64, target []float64) []float64 {
+	gradient := make([]float64, len(output))
+	for i := range output {
+		gradient[i] = target[i] - output[i]
+	}
+	return gradient
+}
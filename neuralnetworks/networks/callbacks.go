@@ -0,0 +1,108 @@
+package networks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/EganBoschCodes/lossless/datasets"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/layers"
+)
+
+/*
+NETWORK - What callbacks get to see of the network being trained.
+
+GetLayers () []layers.Layer: Gets every layer in the network, always in the same order.
+
+Test (dataset []datasets.DataPoint) (float64, float64): Gets the loss averaged per datapoint across the dataset, as well as the
+fraction of datapoints where the largest output lined up with the one-hot target.
+*/
+type Network interface {
+	GetLayers() []layers.Layer
+	Test([]datasets.DataPoint) (float64, float64)
+}
+
+/*
+Everything a callback has access to while training. The epoch and step counters, along with the
+losses so far, live in History, BatchLoss is the loss averaged per datapoint of the batch that was
+just trained on, and LearningRate is the rate its shifts were applied with. Setting Stop will end
+training once the current round of callbacks is done.
+*/
+type TrainingInfo struct {
+	Network     Network
+	TestingData []datasets.DataPoint
+	Config      TrainConfig
+	History     *TrainingHistory
+
+	Elapsed      time.Duration
+	Progress     float64
+	BatchLoss    float64
+	LearningRate float64
+
+	Stop bool
+}
+
+/*
+CALLBACK - Code that runs at certain points while a network trains, set through the network's Callbacks.
+
+OnTrainBegin (info *TrainingInfo): Called once before the first batch.
+
+OnBatchEnd (info *TrainingInfo): Called after every batch's shifts have been applied.
+
+OnEpochEnd (info *TrainingInfo): Called after the batch that finishes an epoch, once its losses are in the History.
+
+OnTrainEnd (info *TrainingInfo): Called once training is over, either from hitting a limit or from a callback stopping it.
+*/
+type Callback interface {
+	OnTrainBegin(*TrainingInfo)
+	OnBatchEnd(*TrainingInfo)
+	OnEpochEnd(*TrainingInfo)
+	OnTrainEnd(*TrainingInfo)
+}
+
+// The default callback, which draws a bar showing how far along training is.
+type ProgressBar struct{}
+
+func (bar *ProgressBar) OnTrainBegin(info *TrainingInfo) {}
+
+func (bar *ProgressBar) OnBatchEnd(info *TrainingInfo) {
+	percent := info.Progress * 100
+	progressBar := ""
+	for i := 0; i < 20; i++ {
+		if i < int(percent)/5 {
+			progressBar = fmt.Sprint(progressBar, "▒")
+			continue
+		}
+		progressBar = fmt.Sprint(progressBar, " ")
+	}
+	fmt.Printf("\rTraining Progress : -{%s}- (%.1f%%)  ", progressBar, percent)
+}
+
+func (bar *ProgressBar) OnEpochEnd(info *TrainingInfo) {}
+
+func (bar *ProgressBar) OnTrainEnd(info *TrainingInfo) {
+	fmt.Println()
+}
+
+func onTrainBegin(callbacks []Callback, info *TrainingInfo) {
+	for _, callback := range callbacks {
+		callback.OnTrainBegin(info)
+	}
+}
+
+func onBatchEnd(callbacks []Callback, info *TrainingInfo) {
+	for _, callback := range callbacks {
+		callback.OnBatchEnd(info)
+	}
+}
+
+func onEpochEnd(callbacks []Callback, info *TrainingInfo) {
+	for _, callback := range callbacks {
+		callback.OnEpochEnd(info)
+	}
+}
+
+func onTrainEnd(callbacks []Callback, info *TrainingInfo) {
+	for _, callback := range callbacks {
+		callback.OnTrainEnd(info)
+	}
+}
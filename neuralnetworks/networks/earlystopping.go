@@ -0,0 +1,97 @@
+package networks
+
+import (
+	"math"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/layers"
+	"github.com/EganBoschCodes/lossless/utils"
+)
+
+/*
+A Callback that keeps an eye on how the network does on the testing data, and stops training once it
+hasn't improved by more than MinDelta for Patience checks in a row (5 by default). It checks at the end
+of every EveryEpochs epochs (every epoch by default), or every EveryBatches batches if that is set.
+The validation loss is watched unless MonitorAccuracy is set, and unless NoRestore is set, the weights
+from the best check are put back into every layer (through ToBytes and FromBytes) when training ends.
+*/
+type EarlyStopping struct {
+	EveryBatches int
+	EveryEpochs  int
+	Patience     int
+	MinDelta     float64
+
+	MonitorAccuracy bool
+	NoRestore       bool
+
+	// Filled in while training; the best value seen, the step it was seen at, and whether training was cut short.
+	Best         float64
+	BestStep     int
+	StoppedEarly bool
+
+	checksSinceBest int
+	snapshot        [][]byte
+}
+
+func (stopper *EarlyStopping) OnTrainBegin(info *TrainingInfo) {
+	if len(info.TestingData) == 0 {
+		panic("EarlyStopping needs testing data to check the network against!")
+	}
+	if stopper.EveryBatches == 0 && stopper.EveryEpochs == 0 {
+		stopper.EveryEpochs = 1
+	}
+	if stopper.Patience == 0 {
+		stopper.Patience = 5
+	}
+
+	stopper.Best = math.Inf(1)
+	if stopper.MonitorAccuracy {
+		stopper.Best = math.Inf(-1)
+	}
+	stopper.BestStep, stopper.StoppedEarly = 0, false
+	stopper.checksSinceBest, stopper.snapshot = 0, nil
+}
+
+func (stopper *EarlyStopping) OnBatchEnd(info *TrainingInfo) {
+	if stopper.EveryBatches > 0 && info.History.Steps%stopper.EveryBatches == 0 {
+		loss, accuracy := info.Network.Test(info.TestingData)
+		stopper.check(info, loss, accuracy)
+	}
+}
+
+func (stopper *EarlyStopping) OnEpochEnd(info *TrainingInfo) {
+	if stopper.EveryBatches == 0 && info.History.Epochs%stopper.EveryEpochs == 0 {
+		// The epoch's validation has already been done, so there's no need to do it again.
+		stopper.check(info, utils.LastOf(info.History.ValidationLoss), utils.LastOf(info.History.ValidationAccuracy))
+	}
+}
+
+func (stopper *EarlyStopping) OnTrainEnd(info *TrainingInfo) {
+	if stopper.NoRestore || stopper.snapshot == nil {
+		return
+	}
+	for i, layer := range info.Network.GetLayers() {
+		layer.FromBytes(stopper.snapshot[i])
+	}
+}
+
+// Compares the latest check against the best so far, saving the weights if it's the new best and stopping if we're out of patience.
+func (stopper *EarlyStopping) check(info *TrainingInfo, loss float64, accuracy float64) {
+	improved := loss < stopper.Best-stopper.MinDelta
+	if stopper.MonitorAccuracy {
+		improved = accuracy > stopper.Best+stopper.MinDelta
+	}
+
+	if improved {
+		stopper.Best, stopper.BestStep, stopper.checksSinceBest = loss, info.History.Steps, 0
+		if stopper.MonitorAccuracy {
+			stopper.Best = accuracy
+		}
+		stopper.snapshot = utils.Map(info.Network.GetLayers(), func(layer layers.Layer) []byte { return layer.ToBytes() })
+		return
+	}
+
+	stopper.checksSinceBest++
+	if stopper.checksSinceBest >= stopper.Patience {
+		info.Stop, stopper.StoppedEarly = true, true
+	}
+}
@@ -3,13 +3,14 @@ package networks
 import (
 	"fmt"
 	"math"
-	"math/rand"
 	"time"
 
 	"github.com/EganBoschCodes/lossless/datasets"
 	"github.com/EganBoschCodes/lossless/neuralnetworks/layers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/losses"
 	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
 	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/schedules"
 	"github.com/EganBoschCodes/lossless/utils"
 	"gonum.org/v1/gonum/mat"
 )
@@ -25,19 +26,28 @@ type LSTM struct {
 	SubBatch     int
 	LearningRate float64
 
+	// Decides how the LearningRate changes over the course of training, constant by default.
+	Schedule schedules.Schedule
+
+	// If set, every value of each gradient is clipped to within plus or minus ClipValue, and the
+	// gradients are scaled down whenever their norm across the whole network is over ClipNorm.
+	// Each sub-batch's gradients are clipped before they go to the Optimizer.
+	ClipValue float64
+	ClipNorm  float64
+
 	numInputs    int
 	numOutputs   int
 	concatInputs int
 
 	Optimizer optimizers.Optimizer
+	Loss      losses.Loss
+
+	// Run while training, a ProgressBar by default. Set to an empty list to train silently.
+	Callbacks []Callback
 }
 
-func (network *LSTM) initializeGate(layers []layers.Layer, numInputs int, expectedOutputs int) {
-	lastOutput := numInputs
-	for _, layer := range layers {
-		layer.Initialize(lastOutput)
-		lastOutput = layer.NumOutputs()
-	}
+func (network *LSTM) initializeGate(gate []layers.Layer, numInputs int, expectedOutputs int) {
+	lastOutput := layers.InitializeStack(gate, numInputs)
 
 	if expectedOutputs > 0 && lastOutput != network.numOutputs {
 		panic("Each gate needs to output the same number of values as the network!")
@@ -46,18 +56,7 @@ func (network *LSTM) initializeGate(layers []layers.Layer, numInputs int, expect
 
 func (network *LSTM) Initialize(numInputs int, numOutputs int, ForgetGate []layers.Layer, InputGate []layers.Layer, CandidateGate []layers.Layer, OutputGate []layers.Layer, InterpretGate []layers.Layer) {
 	network.numInputs, network.numOutputs, network.concatInputs = numInputs, numOutputs, numInputs+numOutputs
-	if network.BatchSize == 0 {
-		network.BatchSize = 8
-	}
-	if network.SubBatch == 0 {
-		network.SubBatch = 1
-	}
-	if network.LearningRate == 0 {
-		network.LearningRate = 0.05
-	}
-	if network.Optimizer == nil {
-		network.Optimizer = &optimizers.GradientDescent{}
-	}
+	network.setDefaults()
 
 	network.ForgetGate, network.InputGate, network.CandidateGate, network.OutputGate, network.InterpretGate = ForgetGate, InputGate, CandidateGate, OutputGate, InterpretGate
 
@@ -96,6 +95,31 @@ func (network *LSTM) Initialize(numInputs int, numOutputs int, ForgetGate []laye
 	network.initializeGate(network.InterpretGate, network.numOutputs, -1)
 }
 
+// Fills in the defaults for any training parameters that weren't set.
+func (network *LSTM) setDefaults() {
+	if network.BatchSize == 0 {
+		network.BatchSize = 8
+	}
+	if network.SubBatch == 0 {
+		network.SubBatch = 1
+	}
+	if network.LearningRate == 0 {
+		network.LearningRate = 0.05
+	}
+	if network.Optimizer == nil {
+		network.Optimizer = &optimizers.GradientDescent{}
+	}
+	if network.Schedule == nil {
+		network.Schedule = &schedules.Constant{}
+	}
+	if network.Loss == nil {
+		network.Loss = &losses.MeanSquaredError{}
+	}
+	if network.Callbacks == nil {
+		network.Callbacks = []Callback{&ProgressBar{}}
+	}
+}
+
 func (network *LSTM) passThroughGate(input *mat.Dense, gate []layers.Layer) *mat.Dense {
 	for _, layer := range gate {
 		input, _ = layer.Pass(input)
@@ -203,7 +227,22 @@ type GateCache struct {
 	caches []layers.CacheType
 }
 
-func (network *LSTM) learn(dataset []datasets.DataPoint, shiftChannel chan [][]layers.ShiftType) {
+// Starts backprop from the loss at the end of the interpret gate. Just like in Sequential, if the
+// gate ends in a softmax and the loss can differentiate straight through it, the softmax is skipped.
+func (network *LSTM) getInterpretGateShifts(cache GateCache, target []float64) ([]layers.ShiftType, *mat.Dense) {
+	output := utils.GetSlice(cache.output)
+	gate, gateCaches := network.InterpretGate, cache.caches
+
+	if softmaxLoss, ok := network.Loss.(losses.SoftmaxLoss); ok && len(gate) > 0 {
+		if _, ok := utils.LastOf(gate).(*layers.SoftmaxLayer); ok {
+			shifts, passback := getGateShifts(gate[:len(gate)-1], gateCaches[:len(gate)-1], utils.FromSlice(softmaxLoss.SoftmaxGradient(output, target)))
+			return append(shifts, &layers.NilShift{}), passback
+		}
+	}
+	return getGateShifts(gate, gateCaches, utils.FromSlice(network.Loss.Gradient(output, target)))
+}
+
+func (network *LSTM) learn(dataset []datasets.DataPoint, shiftChannel chan [][]layers.ShiftType, lossChannel chan float64) {
 	inputSeries, targets := datasets.Split(dataset)
 
 	cellStates, hiddenStates := []*mat.Dense{mat.NewDense(network.numOutputs, 1, nil)}, []*mat.Dense{mat.NewDense(network.numOutputs, 1, nil)}
@@ -249,13 +288,14 @@ func (network *LSTM) learn(dataset []datasets.DataPoint, shiftChannel chan [][]l
 		interpretGateCaches = append(interpretGateCaches, GateCache{output: interpretGateOutput, caches: interpretCache})
 	}
 
+	loss := 0.0
 	cellStateGradient, hiddenStateGradient := mat.NewDense(network.numOutputs, 1, nil), mat.NewDense(network.numOutputs, 1, nil)
 	for i := len(inputSeries) - 1; i >= 0; i-- {
 		initialCellState, finalCellState := cellStates[i], cellStates[i+1]
+		loss += network.Loss.Loss(utils.GetSlice(interpretGateCaches[i].output), targets[i])
 
 		// Calculate the loss through the interpret layer
-		currentFrameLossGradient := utils.FromSlice(utils.DoubleMap(targets[i], utils.GetSlice(interpretGateCaches[i].output), func(a float64, b float64) float64 { return a - b }))
-		localInterpretGateShifts, interpretGatePassback := getGateShifts(network.InterpretGate, interpretGateCaches[i].caches, currentFrameLossGradient)
+		localInterpretGateShifts, interpretGatePassback := network.getInterpretGateShifts(interpretGateCaches[i], targets[i])
 
 		// Average together all the interpret layer shifts
 		interpretGateShifts = utils.DoubleMap(interpretGateShifts, localInterpretGateShifts, func(a layers.ShiftType, b layers.ShiftType) layers.ShiftType { return a.Combine(b) })
@@ -312,22 +352,52 @@ func (network *LSTM) learn(dataset []datasets.DataPoint, shiftChannel chan [][]l
 		hiddenStateGradient = utils.FromSlice(utils.GetSlice(combinedPassback)[:network.numOutputs])
 	}
 
+	loss += layers.Penalty(network.GetLayers()) * float64(len(inputSeries))
+
 	shiftChannel <- [][]layers.ShiftType{forgetGateShifts, inputGateShifts, candidateGateShifts, outputGateShifts, interpretGateShifts}
+	lossChannel <- loss
 }
 
 func (network *LSTM) getLoss(dataset []datasets.DataPoint) float64 {
 	inputs, targets := utils.Map(dataset, func(d datasets.DataPoint) []float64 { return d.Input }), utils.Map(dataset, func(d datasets.DataPoint) []float64 { return d.Output })
 	guesses := network.EvaluateAcrossInterval(inputs)
-	differences := utils.DoubleMap(targets, guesses, utils.Subtract)
-	toMeanSquared := func(a float64) float64 { return 0.5 * a * a }
-	differences = utils.Map(differences, func(a []float64) []float64 { return utils.Map(a, toMeanSquared) })
 
-	return utils.Reduce(utils.Reduce(differences, utils.Add), func(a float64, b float64) float64 { return a + b })
+	return utils.Sum(utils.DoubleMap(guesses, targets, network.Loss.Loss)) + layers.Penalty(network.GetLayers())*float64(len(dataset))
+}
+
+// Runs the dataset through as one long series, and gets the loss averaged per datapoint as well as
+// the fraction of timesteps where the largest output lined up with the one-hot target.
+func (network *LSTM) Test(dataset []datasets.DataPoint) (float64, float64) {
+	inputs, targets := datasets.Split(dataset)
+	guesses := network.EvaluateAcrossInterval(inputs)
+
+	loss := utils.Sum(utils.DoubleMap(guesses, targets, network.Loss.Loss)) + layers.Penalty(network.GetLayers())*float64(len(dataset))
+	correctGuesses := 0
+	for i := range guesses {
+		if utils.GetMaxIndex(guesses[i]) == datasets.FromOneHot(targets[i]) {
+			correctGuesses++
+		}
+	}
+	return loss / float64(len(dataset)), float64(correctGuesses) / float64(len(dataset))
+}
+
+// Gets the layers of every gate, in the order forget, input, candidate, output then interpret.
+func (network *LSTM) GetLayers() []layers.Layer {
+	allLayers := make([]layers.Layer, 0)
+	for _, gate := range [][]layers.Layer{network.ForgetGate, network.InputGate, network.CandidateGate, network.OutputGate, network.InterpretGate} {
+		allLayers = append(allLayers, gate...)
+	}
+	return allLayers
+}
+
+// Puts any layers in the gates that act differently while training into or out of training mode.
+func (network *LSTM) SetTraining(training bool) {
+	layers.SetTraining(network.GetLayers(), training)
 }
 
-func (network *LSTM) applyShiftsToGate(layers []layers.Layer, shifts []layers.ShiftType) {
+func (network *LSTM) applyShiftsToGate(layers []layers.Layer, shifts []layers.ShiftType, learningRate float64) {
 	for i, shift := range shifts {
-		shift.Apply(layers[i], network.LearningRate)
+		shift.Apply(layers[i], learningRate)
 	}
 }
 
@@ -335,7 +405,7 @@ func combineShifts(current []layers.ShiftType, next []layers.ShiftType) []layers
 	return utils.DoubleMap(current, next, func(a layers.ShiftType, b layers.ShiftType) layers.ShiftType { return a.Combine(b) })
 }
 
-func (network *LSTM) applyShifts(shifts [][]layers.ShiftType) {
+func (network *LSTM) applyShifts(shifts [][]layers.ShiftType, learningRate float64) {
 	forgetGateShifts, inputGateShifts, candidateGateShifts, outputGateShifts, interpretGateShifts := shifts[0], shifts[1], shifts[2], shifts[3], shifts[4]
 
 	if !network.Optimizer.Initialized() {
@@ -357,11 +427,11 @@ func (network *LSTM) applyShifts(shifts [][]layers.ShiftType) {
 		}
 		network.Optimizer.Initialize(numShifts)
 	}
-	network.applyShiftsToGate(network.ForgetGate, forgetGateShifts)
-	network.applyShiftsToGate(network.InputGate, inputGateShifts)
-	network.applyShiftsToGate(network.CandidateGate, candidateGateShifts)
-	network.applyShiftsToGate(network.OutputGate, outputGateShifts)
-	network.applyShiftsToGate(network.InterpretGate, interpretGateShifts)
+	network.applyShiftsToGate(network.ForgetGate, forgetGateShifts, learningRate)
+	network.applyShiftsToGate(network.InputGate, inputGateShifts, learningRate)
+	network.applyShiftsToGate(network.CandidateGate, candidateGateShifts, learningRate)
+	network.applyShiftsToGate(network.OutputGate, outputGateShifts, learningRate)
+	network.applyShiftsToGate(network.InterpretGate, interpretGateShifts, learningRate)
 }
 
 func (network *LSTM) optimize(allShifts [][]layers.ShiftType, done chan [][]layers.ShiftType) {
@@ -376,6 +446,9 @@ func (network *LSTM) optimize(allShifts [][]layers.ShiftType, done chan [][]laye
 		network.Optimizer.Initialize(numShifts)
 	}
 
+	// Clip the shifts so nothing explodes before the optimizer remembers them
+	clipShifts(utils.Flatten(allShifts), network.ClipValue, network.ClipNorm)
+
 	// Optimize the shifts!
 	i := 0
 	for _, gateShifts := range allShifts {
@@ -392,25 +465,62 @@ func (network *LSTM) optimize(allShifts [][]layers.ShiftType, done chan [][]laye
 func (network *LSTM) Train(trainingData []datasets.DataPoint, testingData []datasets.DataPoint, stepSize int, timespan time.Duration) {
 	fmt.Printf("Beginning Loss (Training, Testing): %.2f, %.2f\n\n", network.getLoss(trainingData), network.getLoss(testingData))
 
+	history := network.Fit(trainingData, testingData, stepSize, TrainConfig{Timespan: timespan})
+
+	fmt.Printf("\nIntervals Trained: %d\nFinal Loss (Training, Testing): %.2f, %.2f\n", history.Datapoints/stepSize, network.getLoss(trainingData), network.getLoss(testingData))
+}
+
+/*
+Trains on intervals of stepSize consecutive datapoints until one of the limits in the config is
+reached (or a callback stops it), where an epoch is as many intervals as it takes to cover the
+training data once. The testing data is checked at the end of every epoch, progress is reported
+through the network's Callbacks, and everything is returned in the TrainingHistory. With NoShuffle
+set the intervals are taken in order, back to back, rather than starting at random points.
+*/
+func (network *LSTM) Fit(trainingData []datasets.DataPoint, testingData []datasets.DataPoint, stepSize int, config TrainConfig) TrainingHistory {
+	config.check()
+	if layers.HasBatchnorm(network.GetLayers()) {
+		panic("The gates of an LSTM network can't have BatchnormLayers in them while training, since they only see one datapoint at a time!")
+	}
+	if stepSize <= 0 {
+		panic(fmt.Sprintf("Can't train on intervals of %d datapoints! Each interval needs at least one datapoint.", stepSize))
+	}
+	if stepSize > len(trainingData) {
+		panic(fmt.Sprintf("Can't train on intervals of %d datapoints with only %d datapoints to train on!", stepSize, len(trainingData)))
+	}
+	random := config.getRand()
+	intervalsPerEpoch := len(trainingData) / stepSize
+
+	history := TrainingHistory{}
+	info := TrainingInfo{Network: network, TestingData: testingData, Config: config, History: &history}
 	start := time.Now()
-	trainingTime := time.Since(start)
 	intervalsTrainedOn := 0
+	epochLoss, epochDatapoints := 0.0, 0
+
+	onTrainBegin(network.Callbacks, &info)
 
-	for trainingTime < timespan {
+	for !info.Stop && !config.finished(history.Epochs, history.Steps, time.Since(start)) {
 		shiftChannel := make(chan [][]layers.ShiftType)
+		lossChannel := make(chan float64)
 
-		// Start the training intervals
+		// Start the training intervals, with the layers in training mode
+		network.SetTraining(true)
 		for i := 0; i < network.BatchSize; i++ {
-			intervalStart := rand.Intn(len(trainingData) - stepSize)
-			go network.learn(trainingData[intervalStart:intervalStart+stepSize], shiftChannel)
+			intervalStart := (intervalsTrainedOn + i) % intervalsPerEpoch * stepSize
+			if !config.NoShuffle {
+				intervalStart = random.Intn(len(trainingData) - stepSize + 1)
+			}
+			go network.learn(trainingData[intervalStart:intervalStart+stepSize], shiftChannel, lossChannel)
 		}
 
 		// Capture the calculated shifts, compute a sub-average, then send to Optimizer
 		optimizedShiftChannel := make(chan [][]layers.ShiftType)
+		batchLoss := 0.0
 		for item := 0; item < network.BatchSize/network.SubBatch; item++ {
 			var subShifts [][]layers.ShiftType
 			for i := 0; i < network.SubBatch; i++ {
 				datapointShifts := <-shiftChannel
+				batchLoss += <-lossChannel
 				if i == 0 {
 					subShifts = datapointShifts
 				} else {
@@ -426,25 +536,36 @@ func (network *LSTM) Train(trainingData []datasets.DataPoint, testingData []data
 			optimizedShifts := <-optimizedShiftChannel
 			combinedShifts = utils.DoubleMap(combinedShifts, optimizedShifts, combineShifts)
 		}
-		network.applyShifts(combinedShifts)
-
-		// Log how much time is left
-		trainingTime = time.Since(start)
-		steps := math.Min(100, float64(trainingTime*1000/timespan)/10)
-		progressBar := ""
-		for i := 0; i < 20; i++ {
-			if i < int(steps)/5 {
-				progressBar = fmt.Sprint(progressBar, "▒")
-				continue
-			}
-			progressBar = fmt.Sprint(progressBar, " ")
-		}
-		fmt.Printf("\rTraining Progress : -{%s}- (%.1f%%)  ", progressBar, steps)
-
+		network.SetTraining(false)
+		learningRate := network.Schedule.LearningRate(network.LearningRate, history.Steps)
+		network.applyShifts(combinedShifts, learningRate)
+
+		batchSize := network.BatchSize * stepSize
+		history.Steps++
+		history.Datapoints += batchSize
+		epochLoss += batchLoss
+		epochDatapoints += batchSize
+
+		info.Elapsed = time.Since(start)
+		info.Progress = config.progress(history.Epochs, history.Steps, info.Elapsed)
+		info.BatchLoss = batchLoss / float64(batchSize)
+		info.LearningRate = learningRate
+		onBatchEnd(network.Callbacks, &info)
+
+		// Record how the epoch went once we've been through enough intervals to cover the data, once for every
+		// time over it if the batch has more intervals than that
+		previousEpochs := intervalsTrainedOn / intervalsPerEpoch
 		intervalsTrainedOn += network.BatchSize
+		if finishedEpochs := intervalsTrainedOn/intervalsPerEpoch - previousEpochs; finishedEpochs > 0 {
+			finishEpochs(&info, network.Schedule, network.Callbacks, finishedEpochs, epochLoss/float64(epochDatapoints))
+			epochLoss, epochDatapoints = 0, 0
+		}
 	}
 
-	fmt.Printf("\n\nIntervals Trained: %d\nFinal Loss (Training, Testing): %.2f, %.2f\n", intervalsTrainedOn, network.getLoss(trainingData), network.getLoss(testingData))
+	history.Duration = time.Since(start)
+	info.Elapsed = history.Duration
+	onTrainEnd(network.Callbacks, &info)
+	return history
 }
 
 func getGateBytes(gate []layers.Layer) []byte {
@@ -471,7 +592,6 @@ func (network *LSTM) ToBytes() []byte {
 
 func (network *LSTM) toGateFrom(bytes []byte) ([]layers.Layer, []byte) {
 	numLayers, bytes := save.ConstantsFromBytes(bytes[:4])[0], bytes[4:]
-	numOutputs := network.concatInputs
 
 	gateLayers := make([]layers.Layer, numLayers)
 	for i := range gateLayers {
@@ -479,8 +599,6 @@ func (network *LSTM) toGateFrom(bytes []byte) ([]layers.Layer, []byte) {
 		layer := layers.IndexToLayer(constants[0])
 		layer.FromBytes(bytes[8 : 8+constants[1]])
 		bytes = bytes[8+constants[1]:]
-		layer.Initialize(numOutputs)
-		numOutputs = layer.NumOutputs()
 
 		gateLayers[i] = layer
 	}
@@ -497,6 +615,14 @@ func (network *LSTM) FromBytes(bytes []byte) {
 	network.CandidateGate, bytes = network.toGateFrom(bytes)
 	network.OutputGate, bytes = network.toGateFrom(bytes)
 	network.InterpretGate, _ = network.toGateFrom(bytes)
+
+	network.initializeGate(network.ForgetGate, network.concatInputs, network.numOutputs)
+	network.initializeGate(network.InputGate, network.concatInputs, network.numOutputs)
+	network.initializeGate(network.CandidateGate, network.concatInputs, network.numOutputs)
+	network.initializeGate(network.OutputGate, network.concatInputs, network.numOutputs)
+	network.initializeGate(network.InterpretGate, network.numOutputs, -1)
+
+	network.setDefaults()
 }
 
 func (network *LSTM) Save(dir string, name string) {
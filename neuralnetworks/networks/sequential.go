@@ -2,14 +2,15 @@ package networks
 
 import (
 	"fmt"
-	"math"
-	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/EganBoschCodes/lossless/datasets"
 	"github.com/EganBoschCodes/lossless/neuralnetworks/layers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/losses"
 	"github.com/EganBoschCodes/lossless/neuralnetworks/optimizers"
 	"github.com/EganBoschCodes/lossless/neuralnetworks/save"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/schedules"
 	"github.com/EganBoschCodes/lossless/utils"
 
 	"gonum.org/v1/gonum/mat"
@@ -17,13 +18,32 @@ import (
 
 // The baseline network type, this can be used for generic MLPs and CNNs.
 type Sequential struct {
-	Layers       []layers.Layer
+	Layers []layers.Layer
+
+	// Each batch is split into sub-batches of SubBatch datapoints (1 by default), which are each
+	// passed through the network as one matrix and optimized on their own. Setting SubBatch to the
+	// BatchSize passes the whole batch through at once, which is much faster, but means optimizers
+	// like Adam only take one step per batch instead of one per sub-batch. BatchnormLayers need at
+	// least 2 datapoints at a time, so with one in the network the SubBatch defaults to the BatchSize.
 	BatchSize    int
 	SubBatch     int
 	LearningRate float64
 
+	// Decides how the LearningRate changes over the course of training, constant by default.
+	Schedule schedules.Schedule
+
+	// If set, every value of each gradient is clipped to within plus or minus ClipValue, and the
+	// gradients are scaled down whenever their norm across the whole network is over ClipNorm.
+	// Each sub-batch's gradients are clipped before they go to the Optimizer.
+	ClipValue float64
+	ClipNorm  float64
+
 	numInputs int
 	Optimizer optimizers.Optimizer
+	Loss      losses.Loss
+
+	// Run while training, a ProgressBar by default. Set to an empty list to train silently.
+	Callbacks []Callback
 }
 
 /*
@@ -35,17 +55,24 @@ func (network *Sequential) Initialize(numInputs int, ls ...layers.Layer) {
 
 	// Initialize all of the layers with the proper sizing.
 	network.Layers = ls
-	lastOutput := numInputs
-	for index, layer := range ls {
-		network.Layers[index].Initialize(lastOutput)
-		lastOutput = layer.NumOutputs()
-	}
+	layers.InitializeStack(network.Layers, numInputs)
 
+	network.setDefaults()
+}
+
+// Fills in the defaults for any training parameters that weren't set.
+func (network *Sequential) setDefaults() {
 	if network.BatchSize == 0 {
 		network.BatchSize = 8
 	}
 	if network.SubBatch == 0 {
 		network.SubBatch = 1
+		if layers.HasBatchnorm(network.Layers) {
+			network.SubBatch = network.BatchSize
+		}
+	}
+	if network.SubBatch > network.BatchSize {
+		network.SubBatch = network.BatchSize
 	}
 	if network.LearningRate == 0 {
 		network.LearningRate = 0.05
@@ -53,6 +80,15 @@ func (network *Sequential) Initialize(numInputs int, ls ...layers.Layer) {
 	if network.Optimizer == nil {
 		network.Optimizer = &optimizers.GradientDescent{}
 	}
+	if network.Schedule == nil {
+		network.Schedule = &schedules.Constant{}
+	}
+	if network.Loss == nil {
+		network.Loss = &losses.MeanSquaredError{}
+	}
+	if network.Callbacks == nil {
+		network.Callbacks = []Callback{&ProgressBar{}}
+	}
 }
 
 /*
@@ -73,42 +109,98 @@ func (network *Sequential) Evaluate(input []float64) []float64 {
 }
 
 /*
-Takes in an input, a target value, then calculates the weight shifts for all layers
-based on said input and target, and then passes the list of per-layer weight shifts
-to the channel so that we can add it to the batch's shift.
+Takes in a batch of equal length inputs and passes them through the network all at once,
+as the columns of a single matrix.
+*/
+func (network *Sequential) EvaluateBatch(inputs [][]float64) [][]float64 {
+	inputMat := utils.FromColumns(inputs)
+	for _, layer := range network.Layers {
+		inputMat, _ = layer.Pass(inputMat)
+	}
+	return utils.ToColumns(inputMat)
+}
+
+/*
+Takes in a batch of datapoints, then calculates the weight shifts for all layers based on
+said inputs and targets, averaged across the batch, and then passes the list of per-layer
+weight shifts to the channel so that we can optimize it and add it to the overall shift.
+The total loss across the batch is passed along too, so that training can keep track of it.
 */
-func (network *Sequential) learn(input []float64, target []float64, channel chan []layers.ShiftType) {
+func (network *Sequential) learn(batch []datasets.DataPoint, channel chan []layers.ShiftType, lossChannel chan float64) {
+	inputs, targets := datasets.Split(batch)
+
+	var shifts []layers.ShiftType
+	var loss float64
+	if utils.All(inputs, func(input []float64) bool { return len(input) == len(inputs[0]) }) {
+		// The usual case; the whole batch goes through at once as the columns of one matrix.
+		shifts, loss = network.getShifts(utils.FromColumns(inputs), targets)
+	} else {
+		// Inputs of different lengths can't share a matrix, so they each go through on their own.
+		shifts = network.getEmptyShift()
+		for i := range inputs {
+			datapointShifts, datapointLoss := network.getShifts(utils.FromSlice(inputs[i]), targets[i:i+1])
+			for j := range shifts {
+				shifts[j] = shifts[j].Combine(datapointShifts[j])
+			}
+			loss += datapointLoss
+		}
+	}
+
+	for _, shift := range shifts {
+		shift.Scale(1.0 / float64(len(batch)))
+	}
+	channel <- shifts
+	lossChannel <- loss
+}
+
+// Does the actual forward and backward passes for a batch, with each column of the input being a datapoint.
+// Returns the shifts for each layer, and the total loss of the batch before they're applied.
+func (network *Sequential) getShifts(input *mat.Dense, targets [][]float64) ([]layers.ShiftType, float64) {
 	// Done very similarly to Evaluate, but we just cache the inputs basically so we can use them to do backprop.
 	caches := make([]layers.CacheType, 0)
 
-	var nextInput *mat.Dense
-	nextInput = mat.NewDense(len(input), 1, input)
+	nextInput := input
 	for _, layer := range network.Layers {
 		layerOutput, layerCache := layer.Pass(nextInput)
 
 		caches = append(caches, layerCache)
 		nextInput = layerOutput
 	}
+	loss := utils.Sum(utils.DoubleMap(utils.ToColumns(nextInput), targets, network.Loss.Loss))
+	loss += layers.Penalty(network.Layers) * float64(len(targets))
 
 	// Now we start the gradient that we're gonna be passing back
-	gradient := make([]float64, len(target))
-	for i := range target {
-		// Basic cross-entropy loss gradient.
-		gradient[i] = (target[i] - nextInput.At(i, 0))
-	}
-	var gradientMat *mat.Dense
-	gradientMat = mat.NewDense(len(gradient), 1, gradient)
+	gradientMat, lastLayer := network.lossGradient(nextInput, targets)
 
 	// Get all the shifts for each layer
-	shifts := make([]layers.ShiftType, len(network.Layers))
-	for i := len(network.Layers) - 1; i >= 0; i-- {
+	shifts := network.getEmptyShift()
+	for i := lastLayer; i >= 0; i-- {
 		layer := network.Layers[i]
 		shift, gradientTemp := layer.Back(caches[i], gradientMat)
 		gradientMat = gradientTemp
 		shifts[i] = shift
 	}
 
-	channel <- shifts
+	return shifts, loss
+}
+
+/*
+Gets the gradient of the loss to start backprop with, as well as the index of the
+last layer that needs to be passed back through. If the network ends in a softmax
+and the loss can differentiate straight through it, the softmax layer is skipped.
+*/
+func (network *Sequential) lossGradient(outputs *mat.Dense, targets [][]float64) (*mat.Dense, int) {
+	lastLayer := len(network.Layers) - 1
+	gradient := network.Loss.Gradient
+
+	if softmaxLoss, ok := network.Loss.(losses.SoftmaxLoss); ok {
+		if _, ok := network.Layers[lastLayer].(*layers.SoftmaxLayer); ok {
+			gradient = softmaxLoss.SoftmaxGradient
+			lastLayer--
+		}
+	}
+
+	return utils.FromColumns(utils.DoubleMap(utils.ToColumns(outputs), targets, gradient)), lastLayer
 }
 
 /*
@@ -121,10 +213,7 @@ func (network *Sequential) getLoss(datapoint datasets.DataPoint, lossChannel cha
 	input, target := datapoint.Input, datapoint.Output
 	output := network.Evaluate(input)
 
-	loss := 0.0
-	for i := range output {
-		loss += 0.5 * (output[i] - target[i]) * (output[i] - target[i])
-	}
+	loss := network.Loss.Loss(output, target)
 
 	wasCorrect := utils.GetMaxIndex(output) == datasets.FromOneHot(target)
 
@@ -157,10 +246,17 @@ func (network *Sequential) getTotalLoss(dataset []datasets.DataPoint) (float64,
 		}
 		valuesRecieved++
 	}
+	loss += layers.Penalty(network.Layers) * float64(sampleSize)
 
 	return loss, correctGuesses
 }
 
+// Gets the loss averaged per datapoint across the dataset, and the fraction of the dataset guessed correctly.
+func (network *Sequential) Test(dataset []datasets.DataPoint) (float64, float64) {
+	loss, correctGuesses := network.getTotalLoss(dataset)
+	return loss / float64(len(dataset)), float64(correctGuesses) / float64(len(dataset))
+}
+
 // Takes in a dataset and prints to Standard Output the loss and accuracy across the dataset.
 func (network *Sequential) TestOnAndLog(dataset []datasets.DataPoint) {
 	network.testOnAndLogWithPrefix(dataset, "Testing Set ")
@@ -189,6 +285,8 @@ func (network *Sequential) getEmptyShift() []layers.ShiftType {
 }
 
 func (network *Sequential) optimize(shifts []layers.ShiftType, done chan []layers.ShiftType) {
+	clipShifts(shifts, network.ClipValue, network.ClipNorm)
+
 	i := 0
 	for _, layerShift := range shifts {
 		layerShift.Optimize(network.Optimizer, i)
@@ -204,90 +302,121 @@ func (network *Sequential) Train(dataset []datasets.DataPoint, testingData []dat
 	network.testOnAndLogWithPrefix(testingData, "Beginning ")
 	fmt.Println()
 
+	history := network.Fit(dataset, testingData, TrainConfig{Timespan: timespan})
+
+	// Log how we did
+	network.testOnAndLogWithPrefix(testingData, "Final ")
+	fmt.Printf("\rTrained Epochs: %d, Trained Datapoints: %d", history.Epochs, history.Datapoints)
+}
+
+/*
+Trains on the dataset until one of the limits in the config is reached (or a callback stops it),
+checking how it does on the testing data (if there is any) at the end of every epoch. Progress is
+reported through the network's Callbacks, and everything that happened is returned in the
+TrainingHistory.
+*/
+func (network *Sequential) Fit(dataset []datasets.DataPoint, testingData []datasets.DataPoint, config TrainConfig) TrainingHistory {
+	config.check()
+	random := config.getRand()
+	shuffle := func() {
+		if !config.NoShuffle {
+			random.Shuffle(len(dataset), func(i, j int) { dataset[i], dataset[j] = dataset[j], dataset[i] })
+		}
+	}
+	shuffle()
+
 	// Start the tracking data
+	history := TrainingHistory{}
+	info := TrainingInfo{Network: network, TestingData: testingData, Config: config, History: &history}
 	start := time.Now()
 	datapointIndex := 0
-	epochs := 0
+	epochLoss, epochDatapoints := 0.0, 0
+
+	onTrainBegin(network.Callbacks, &info)
 
-	trainingTime := time.Since(start)
-	for trainingTime < timespan {
+	numSubBatches := network.BatchSize / network.SubBatch
+	for !info.Stop && !config.finished(history.Epochs, history.Steps, time.Since(start)) {
 
-		// Prepare to capture the weight shifts from each datapoint in the batch
+		// Prepare to capture the weight shifts from each sub-batch
 		shifts := network.getEmptyShift()
 
 		shiftChannel := make(chan []layers.ShiftType)
-		// Start the weight calculations with goroutines
-		for item := 0; item < network.BatchSize; item++ {
-			datapoint := dataset[datapointIndex]
-
-			go network.learn(datapoint.Input, datapoint.Output, shiftChannel)
-
-			datapointIndex++
-			if datapointIndex >= len(dataset) {
-				datapointIndex = 0
-				rand.Shuffle(len(dataset), func(i, j int) { dataset[i], dataset[j] = dataset[j], dataset[i] })
-				epochs++
+		lossChannel := make(chan float64)
+		finishedEpochs := 0
+		// Start the weight calculations with goroutines, one per sub-batch, with the layers in training mode
+		network.SetTraining(true)
+		for item := 0; item < numSubBatches; item++ {
+			subBatch := make([]datasets.DataPoint, network.SubBatch)
+			for i := range subBatch {
+				subBatch[i] = dataset[datapointIndex]
+
+				datapointIndex++
+				if datapointIndex >= len(dataset) {
+					datapointIndex = 0
+					shuffle()
+					finishedEpochs++
+				}
 			}
+
+			go network.learn(subBatch, shiftChannel, lossChannel)
 		}
 
 		optimizedShiftChannel := make(chan []layers.ShiftType)
+		batchLoss := 0.0
 		// Capture the calculated weight shifts as they finish and pass to optimizer threads
-
-		for item := 0; item < network.BatchSize/network.SubBatch; item++ {
-			var minibatchShifts []layers.ShiftType
-			for i := 0; i < network.SubBatch; i++ {
-				datapointShifts := <-shiftChannel
-				if !network.Optimizer.Initialized() {
-					numShifts := 0
-					for _, shift := range datapointShifts {
-						numShifts += shift.NumMatrices()
-					}
-					network.Optimizer.Initialize(numShifts)
-				}
-				if i == 0 {
-					minibatchShifts = datapointShifts
-				} else {
-					for i, layer := range datapointShifts {
-						minibatchShifts[i] = minibatchShifts[i].Combine(layer)
-					}
+		for item := 0; item < numSubBatches; item++ {
+			subBatchShifts := <-shiftChannel
+			batchLoss += <-lossChannel
+			if !network.Optimizer.Initialized() {
+				numShifts := 0
+				for _, shift := range subBatchShifts {
+					numShifts += shift.NumMatrices()
 				}
+				network.Optimizer.Initialize(numShifts)
 			}
 
-			go network.optimize(minibatchShifts, optimizedShiftChannel)
+			go network.optimize(subBatchShifts, optimizedShiftChannel)
 		}
 
 		// Recieve the Optimized weight shifts
-		for item := 0; item < network.BatchSize/network.SubBatch; item++ {
-			datapointShifts := <-optimizedShiftChannel
+		for item := 0; item < numSubBatches; item++ {
+			subBatchShifts := <-optimizedShiftChannel
 			for i := range shifts {
-				shifts[i] = shifts[i].Combine(datapointShifts[i])
+				shifts[i] = shifts[i].Combine(subBatchShifts[i])
 			}
 		}
+		network.SetTraining(false)
 
 		// Once all shifts have been added in, apply the averaged shifts to all layers
+		learningRate := network.Schedule.LearningRate(network.LearningRate, history.Steps)
 		for i, shift := range shifts {
-			shift.Scale(1.0 / float64(network.BatchSize))
-			shift.Apply(network.Layers[i], network.LearningRate)
+			shift.Scale(1.0 / float64(numSubBatches))
+			shift.Apply(network.Layers[i], learningRate)
 		}
 
-		// Just let me know how much time is left
-		trainingTime = time.Since(start)
-		steps := math.Min(float64(trainingTime*1000/timespan)/10, 100)
-		progressBar := ""
-		for i := 0; i < 20; i++ {
-			if i < int(steps)/5 {
-				progressBar = fmt.Sprint(progressBar, "▒")
-				continue
-			}
-			progressBar = fmt.Sprint(progressBar, " ")
+		batchSize := numSubBatches * network.SubBatch
+		history.Steps++
+		history.Datapoints += batchSize
+		epochLoss += batchLoss
+		epochDatapoints += batchSize
+
+		info.Elapsed = time.Since(start)
+		info.Progress = config.progress(history.Epochs, history.Steps, info.Elapsed)
+		info.BatchLoss = batchLoss / float64(batchSize)
+		info.LearningRate = learningRate
+		onBatchEnd(network.Callbacks, &info)
+
+		// Record how the epoch went, once for every time the batch wrapped around the dataset
+		if finishedEpochs > 0 {
+			finishEpochs(&info, network.Schedule, network.Callbacks, finishedEpochs, epochLoss/float64(epochDatapoints))
+			epochLoss, epochDatapoints = 0, 0
 		}
-		fmt.Printf("\rTraining Progress : -{%s}- (%.1f%%)  ", progressBar, steps)
 	}
 
-	// Log how we did
-	fmt.Println()
-	network.testOnAndLogWithPrefix(testingData, "Final ")
-	fmt.Printf("\rTrained Epochs: %d, Trained Datapoints: %d", epochs, epochs*len(dataset)+datapointIndex)
+	history.Duration = time.Since(start)
+	info.Elapsed = history.Duration
+	onTrainEnd(network.Callbacks, &info)
+	return history
 }
 
 // This is just for some sanity checking. This lets you see the datapoints
@@ -325,7 +454,6 @@ func (network *Sequential) FromBytes(bytes []byte) {
 	network.numInputs = save.ConstantsFromBytes(bytes[:4])[0]
 	network.Layers = make([]layers.Layer, 0)
 
-	lastOutput := network.numInputs
 	i := 4
 	for i < len(bytes) {
 		layerData := save.ConstantsFromBytes(bytes[i : i+8])
@@ -337,15 +465,11 @@ func (network *Sequential) FromBytes(bytes []byte) {
 		layer.FromBytes(bytes[i : i+dataLength])
 		i += dataLength
 
-		layer.Initialize(lastOutput)
-		lastOutput = layer.NumOutputs()
-
 		network.Layers = append(network.Layers, layer)
 	}
+	layers.InitializeStack(network.Layers, network.numInputs)
 
-	if network.Optimizer == nil {
-		network.Optimizer = &optimizers.GradientDescent{}
-	}
+	network.setDefaults()
 }
 
 // Saves your Sequential into a .lsls file, with the path [Project Directory]/{dir}/{name}.lsls.
@@ -369,6 +493,18 @@ func (network *Sequential) Open(dir string, name string) {
 	network.FromBytes(rawBytes)
 }
 
+/*
+Puts any layers that act differently while training (like DropoutLayer) into or out of training mode.
+Fit takes care of this on its own, so this only needs calling when doing something custom.
+*/
+func (network *Sequential) SetTraining(training bool) {
+	layers.SetTraining(network.Layers, training)
+}
+
+func (network *Sequential) GetLayers() []layers.Layer {
+	return network.Layers
+}
+
 func (network *Sequential) PrettyPrint() string {
 	outputString := ""
 	for i, layer := range network.Layers {
@@ -379,3 +515,21 @@ func (network *Sequential) PrettyPrint() string {
 	}
 	return outputString
 }
+
+/*
+Gets a table of the layers in the network, with how many values each one outputs and how many parameters it
+learns, followed by the total number of parameters in the whole network.
+*/
+func (network *Sequential) Summary() string {
+	divider := strings.Repeat("-", 60) + "\n"
+	summary := fmt.Sprintf("%-32s%12s%16s\n", "Layer", "Outputs", "Parameters") + divider
+	for _, layer := range network.Layers {
+		outputs := "variable"
+		if layer.NumOutputs() >= 0 {
+			outputs = fmt.Sprint(layer.NumOutputs())
+		}
+		name := strings.TrimPrefix(fmt.Sprintf("%T", layer), "*layers.")
+		summary += fmt.Sprintf("%-32s%12s%16d\n", name, outputs, layers.NumParameters([]layers.Layer{layer}))
+	}
+	return summary + divider + fmt.Sprintf("Total Parameters: %d\n", layers.NumParameters(network.Layers))
+}
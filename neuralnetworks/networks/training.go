@@ -0,0 +1,139 @@
+package networks
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/EganBoschCodes/lossless/neuralnetworks/layers"
+	"github.com/EganBoschCodes/lossless/neuralnetworks/schedules"
+	"github.com/EganBoschCodes/lossless/utils"
+)
+
+/*
+Settings for a training run. Training stops as soon as any one of Epochs, Steps (the number of
+batches applied) or Timespan is reached, and any left at zero are ignored, so at least one needs
+to be set. Seed controls the order the data is visited in, so runs with the same Seed see the data
+in the same order; leaving it at zero picks one based on the time.
+*/
+type TrainConfig struct {
+	Epochs   int
+	Steps    int
+	Timespan time.Duration
+
+	NoShuffle bool
+	Seed      int64
+}
+
+/*
+What happened over the course of a training run. The losses are averaged per datapoint, and there
+is one entry in each of the per-epoch lists for every completed epoch (a batch bigger than the data
+completes several at once, which all share its losses). The validation entries are only recorded if
+there was testing data to validate against, and ValidationAccuracy is the fraction of datapoints
+where the largest output matched the one-hot target.
+*/
+type TrainingHistory struct {
+	Epochs     int
+	Steps      int
+	Datapoints int
+	Duration   time.Duration
+
+	TrainingLoss       []float64
+	ValidationLoss     []float64
+	ValidationAccuracy []float64
+}
+
+func (config *TrainConfig) check() {
+	if config.Epochs <= 0 && config.Steps <= 0 && config.Timespan <= 0 {
+		panic("You must give your TrainConfig at least one of Epochs, Steps or Timespan to know when to stop!")
+	}
+}
+
+func (config *TrainConfig) getRand() *rand.Rand {
+	if config.Seed == 0 {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return rand.New(rand.NewSource(config.Seed))
+}
+
+// How far along training is, from 0 to 1, going by whichever limit is closest to being hit.
+func (config *TrainConfig) progress(epochs int, steps int, elapsed time.Duration) float64 {
+	progress := 0.0
+	if config.Epochs > 0 {
+		progress = math.Max(progress, float64(epochs)/float64(config.Epochs))
+	}
+	if config.Steps > 0 {
+		progress = math.Max(progress, float64(steps)/float64(config.Steps))
+	}
+	if config.Timespan > 0 {
+		progress = math.Max(progress, float64(elapsed)/float64(config.Timespan))
+	}
+	return math.Min(progress, 1)
+}
+
+func (config *TrainConfig) finished(epochs int, steps int, elapsed time.Duration) bool {
+	return config.progress(epochs, steps, elapsed) >= 1
+}
+
+// Lets schedules that watch the loss know how the epoch that just finished went.
+func observeEpoch(schedule schedules.Schedule, history *TrainingHistory) {
+	observer, ok := schedule.(schedules.Observer)
+	if !ok {
+		return
+	}
+	if len(history.ValidationLoss) > 0 {
+		observer.Observe(utils.LastOf(history.ValidationLoss))
+		return
+	}
+	observer.Observe(utils.LastOf(history.TrainingLoss))
+}
+
+/*
+Clips every value in the shifts to be within plus or minus clipValue, then if the norm across all of the
+shifts together is more than clipNorm, scales them all down so that it isn't. Either is skipped if zero.
+*/
+func clipShifts(shifts []layers.ShiftType, clipValue float64, clipNorm float64) {
+	if clipValue > 0 {
+		for _, shift := range shifts {
+			shift.Clip(clipValue)
+		}
+	}
+
+	if clipNorm > 0 {
+		squaredNorm := 0.0
+		for _, shift := range shifts {
+			squaredNorm += shift.SquaredNorm()
+		}
+		if norm := math.Sqrt(squaredNorm); norm > clipNorm {
+			for _, shift := range shifts {
+				shift.Scale(clipNorm / norm)
+			}
+		}
+	}
+}
+
+/*
+Records the epochs that finished over the last batch, which is more than one if the batch wrapped around the training
+data more than once. They all get the average loss of the datapoints trained on since the last recorded epoch, and
+the testing data is only checked once for all of them.
+*/
+func finishEpochs(info *TrainingInfo, schedule schedules.Schedule, callbacks []Callback, finished int, trainingLoss float64) {
+	history := info.History
+	validationLoss, validationAccuracy := 0.0, 0.0
+	if len(info.TestingData) > 0 {
+		validationLoss, validationAccuracy = info.Network.Test(info.TestingData)
+	}
+
+	for i := 0; i < finished; i++ {
+		history.Epochs++
+		history.TrainingLoss = append(history.TrainingLoss, trainingLoss)
+		if len(info.TestingData) > 0 {
+			history.ValidationLoss = append(history.ValidationLoss, validationLoss)
+			history.ValidationAccuracy = append(history.ValidationAccuracy, validationAccuracy)
+		}
+
+		observeEpoch(schedule, history)
+		info.Progress = info.Config.progress(history.Epochs, history.Steps, info.Elapsed)
+		onEpochEnd(callbacks, info)
+	}
+}
@@ -0,0 +1,8 @@
+package schedules
+
+// The default schedule, which just uses the network's LearningRate the whole way through.
+type Constant struct{}
+
+func (c *Constant) LearningRate(base float64, _ int) float64 {
+	return base
+}
@@ -0,0 +1,36 @@
+package schedules
+
+import "math"
+
+/*
+Follows half a cosine wave from the base learning rate down to MinRate over Period steps, then jumps
+back up and starts again (a warm restart). If PeriodMultiplier is set, each period is that many times
+longer than the one before it.
+*/
+type CosineAnnealing struct {
+	Period           int
+	PeriodMultiplier float64
+	MinRate          float64
+}
+
+func (c *CosineAnnealing) LearningRate(base float64, step int) float64 {
+	if c.Period <= 0 {
+		panic("You must set how many steps long a CosineAnnealing cycle is with Period!")
+	}
+	if c.PeriodMultiplier == 0 {
+		c.PeriodMultiplier = 1
+	}
+
+	// Find how far into the current period we are
+	position, period := float64(step), float64(c.Period)
+	if c.PeriodMultiplier == 1 {
+		position = math.Mod(position, period)
+	} else {
+		for position >= period {
+			position -= period
+			period *= c.PeriodMultiplier
+		}
+	}
+
+	return c.MinRate + (base-c.MinRate)*(1+math.Cos(math.Pi*position/period))/2
+}
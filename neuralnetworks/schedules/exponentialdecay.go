@@ -0,0 +1,19 @@
+package schedules
+
+import "math"
+
+// Smoothly shrinks the learning rate so that it is multiplied by Rate every DecaySteps steps (1 by default).
+type ExponentialDecay struct {
+	Rate       float64
+	DecaySteps int
+}
+
+func (e *ExponentialDecay) LearningRate(base float64, step int) float64 {
+	if e.Rate <= 0 || e.Rate > 1 {
+		panic("An ExponentialDecay needs a Rate between 0 and 1!")
+	}
+	if e.DecaySteps == 0 {
+		e.DecaySteps = 1
+	}
+	return base * math.Pow(e.Rate, float64(step)/float64(e.DecaySteps))
+}
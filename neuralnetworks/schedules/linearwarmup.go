@@ -0,0 +1,26 @@
+package schedules
+
+/*
+Ramps the learning rate linearly up to the base rate over the first WarmupSteps steps, and from then
+on hands over to the After schedule (constant by default), which starts counting its steps from 0.
+*/
+type LinearWarmup struct {
+	WarmupSteps int
+	After       Schedule
+}
+
+func (w *LinearWarmup) LearningRate(base float64, step int) float64 {
+	if w.After == nil {
+		w.After = &Constant{}
+	}
+	if step < w.WarmupSteps {
+		return base * float64(step+1) / float64(w.WarmupSteps)
+	}
+	return w.After.LearningRate(base, step-w.WarmupSteps)
+}
+
+func (w *LinearWarmup) Observe(loss float64) {
+	if observer, ok := w.After.(Observer); ok {
+		observer.Observe(loss)
+	}
+}
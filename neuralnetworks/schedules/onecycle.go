@@ -0,0 +1,43 @@
+package schedules
+
+import "math"
+
+/*
+The one-cycle policy; over the first WarmupFraction (0.3 by default) of TotalSteps, the learning rate
+climbs from base/StartDivisor (25 by default) up to the base rate, then it anneals back down to
+base/FinalDivisor (10000 by default) by the end. Both halves follow a cosine curve, and any steps
+past TotalSteps stay at the final rate.
+*/
+type OneCycle struct {
+	TotalSteps     int
+	WarmupFraction float64
+	StartDivisor   float64
+	FinalDivisor   float64
+}
+
+func (o *OneCycle) LearningRate(base float64, step int) float64 {
+	if o.TotalSteps <= 0 {
+		panic("You must set how many steps a OneCycle lasts for with TotalSteps!")
+	}
+	if o.WarmupFraction == 0 {
+		o.WarmupFraction = 0.3
+	}
+	if o.StartDivisor == 0 {
+		o.StartDivisor = 25
+	}
+	if o.FinalDivisor == 0 {
+		o.FinalDivisor = 1e4
+	}
+
+	warmupSteps := o.WarmupFraction * float64(o.TotalSteps)
+	position := math.Min(float64(step), float64(o.TotalSteps))
+	if position < warmupSteps {
+		return cosineBetween(base/o.StartDivisor, base, position/warmupSteps)
+	}
+	return cosineBetween(base, base/o.FinalDivisor, (position-warmupSteps)/(float64(o.TotalSteps)-warmupSteps))
+}
+
+// Moves from start to end along half a cosine wave as progress goes from 0 to 1.
+func cosineBetween(start float64, end float64, progress float64) float64 {
+	return end + (start-end)*(1+math.Cos(math.Pi*progress))/2
+}
@@ -0,0 +1,54 @@
+package schedules
+
+import "math"
+
+/*
+Multiplies the learning rate by Factor (0.1 by default) whenever the observed loss hasn't improved by
+more than MinDelta for Patience epochs in a row (10 by default), never going below MinRate.
+*/
+type ReduceOnPlateau struct {
+	Factor   float64
+	Patience int
+	MinDelta float64
+	MinRate  float64
+
+	multiplier      float64
+	best            float64
+	epochsSinceBest int
+	initialized     bool
+}
+
+func (r *ReduceOnPlateau) initialize() {
+	if r.Factor == 0 {
+		r.Factor = 0.1
+	}
+	if r.Patience == 0 {
+		r.Patience = 10
+	}
+	r.multiplier, r.best = 1, math.Inf(1)
+	r.initialized = true
+}
+
+func (r *ReduceOnPlateau) LearningRate(base float64, _ int) float64 {
+	if !r.initialized {
+		r.initialize()
+	}
+	return math.Max(base*r.multiplier, r.MinRate)
+}
+
+func (r *ReduceOnPlateau) Observe(loss float64) {
+	if !r.initialized {
+		r.initialize()
+	}
+
+	if loss < r.best-r.MinDelta {
+		r.best, r.epochsSinceBest = loss, 0
+		return
+	}
+
+	r.epochsSinceBest++
+	if r.epochsSinceBest >= r.Patience {
+		r.multiplier *= r.Factor
+		r.epochsSinceBest = 0
+	}
+}
@@ -0,0 +1,19 @@
+package schedules
+
+/*
+SCHEDULE - Decides what the learning rate should be at each step of training.
+
+LearningRate (base float64, step int) float64: Gets the learning rate to use for the given step (counting from 0),
+where base is the LearningRate set on the network.
+*/
+type Schedule interface {
+	LearningRate(float64, int) float64
+}
+
+/*
+Schedules that react to how training is going also implement Observer, and are told the loss at the
+end of every epoch (the validation loss if there is testing data, otherwise the training loss).
+*/
+type Observer interface {
+	Observe(float64)
+}
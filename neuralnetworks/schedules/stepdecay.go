@@ -0,0 +1,19 @@
+package schedules
+
+import "math"
+
+// Multiplies the learning rate by Gamma (0.1 by default) every StepSize steps.
+type StepDecay struct {
+	StepSize int
+	Gamma    float64
+}
+
+func (s *StepDecay) LearningRate(base float64, step int) float64 {
+	if s.StepSize <= 0 {
+		panic("You must set how many steps a StepDecay waits between decays with StepSize!")
+	}
+	if s.Gamma == 0 {
+		s.Gamma = 0.1
+	}
+	return base * math.Pow(s.Gamma, float64(step/s.StepSize))
+}
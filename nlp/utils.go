@@ -48,3 +48,18 @@ func GetMapping(tokens []string) map[string]int {
 	}
 	return mapping
 }
+
+// Looks up the embedding of each token and lays them end to end, so that a tokenized string can be passed into a
+// network whose layers read InputSize long tokens (like a TransformerEncoderLayer). The result is always length
+// tokens long; longer strings are cut short, and shorter ones are padded out with zero vectors.
+func EmbedTokens(tokenized []int, embeddings [][]float64, length int) []float64 {
+	dimensions := len(embeddings[0])
+	embedded := make([]float64, length*dimensions)
+	for i, token := range tokenized {
+		if i >= length {
+			break
+		}
+		copy(embedded[i*dimensions:(i+1)*dimensions], embeddings[token])
+	}
+	return embedded
+}
@@ -20,6 +20,98 @@ func DenseLike(m mat.Matrix) *mat.Dense {
 	return mat.NewDense(r, c, nil)
 }
 
+/*
+	Batch Helpers:
+	----------------------------------------------------------------------------------
+	When a batch is passed through a network all at once, each datapoint is a column
+	of the matrix being passed around. These make it easier to go back and forth
+	between that and the slices of individual datapoints.
+*/
+
+// Stacks equal length slices side by side as the columns of a matrix.
+func FromColumns(columns [][]float64) *mat.Dense {
+	rows, cols := len(columns[0]), len(columns)
+	data := make([]float64, rows*cols)
+	for c, column := range columns {
+		if len(column) != rows {
+			panic(fmt.Sprintf("Can't stack a column of length %d next to columns of length %d!", len(column), rows))
+		}
+		for r, v := range column {
+			data[r*cols+c] = v
+		}
+	}
+	return mat.NewDense(rows, cols, data)
+}
+
+// Splits a matrix back up into a slice for each of its columns.
+func ToColumns(m mat.Matrix) [][]float64 {
+	_, cols := m.Dims()
+	columns := make([][]float64, cols)
+	for c := range columns {
+		columns[c] = mat.Col(nil, c, m)
+	}
+	return columns
+}
+
+// Adds the column vector to every column of the matrix, in place.
+func AddToColumns(m *mat.Dense, column *mat.Dense) {
+	raw, columnSlice := m.RawMatrix(), GetSlice(column)
+	for r := 0; r < raw.Rows; r++ {
+		row := raw.Data[r*raw.Stride : r*raw.Stride+raw.Cols]
+		for c := range row {
+			row[c] += columnSlice[r]
+		}
+	}
+}
+
+// Sums all the columns of the matrix together into a single column.
+func SumColumns(m *mat.Dense) *mat.Dense {
+	raw := m.RawMatrix()
+	sums := make([]float64, raw.Rows)
+	for r := range sums {
+		for _, v := range raw.Data[r*raw.Stride : r*raw.Stride+raw.Cols] {
+			sums[r] += v
+		}
+	}
+	return FromSlice(sums)
+}
+
+// Repeats the column vector to fill a matrix with the given number of columns.
+func RepeatColumn(column *mat.Dense, cols int) *mat.Dense {
+	rows, _ := column.Dims()
+	repeated := mat.NewDense(rows, cols, nil)
+	AddToColumns(repeated, column)
+	return repeated
+}
+
+/*
+	Gradient Clipping Helpers:
+	----------------------------------------------------------------------------------
+	Used by the shift types to measure and bound how big of a step they'd take.
+*/
+
+// Gets the sum of the squares of every entry in the matrix.
+func SquaredNorm(m *mat.Dense) float64 {
+	raw, sum := m.RawMatrix(), 0.0
+	for r := 0; r < raw.Rows; r++ {
+		for _, v := range raw.Data[r*raw.Stride : r*raw.Stride+raw.Cols] {
+			sum += v * v
+		}
+	}
+	return sum
+}
+
+// Clamps every entry of the matrix to be between -limit and limit, in place.
+func ClipValues(m *mat.Dense, limit float64) {
+	raw := m.RawMatrix()
+	for r := 0; r < raw.Rows; r++ {
+		row := raw.Data[r*raw.Stride : r*raw.Stride+raw.Cols]
+		for c, v := range row {
+			row[c] = math.Max(-limit, math.Min(limit, v))
+		}
+	}
+}
+
 /*
 	Standard Matrix Convolution:
 	----------------------------------------------------------------------------------
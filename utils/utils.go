@@ -21,6 +21,15 @@ func Abs(a int) int {
 	return a
 }
 
+func Sign(a float64) float64 {
+	if a > 0 {
+		return 1
+	} else if a < 0 {
+		return -1
+	}
+	return 0
+}
+
 // Essentially getting a column of a matrix
 func getParallelIndex[T any](index int, values ...[]T) []T {
 	par := make([]T, len(values))